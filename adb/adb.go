@@ -2,14 +2,18 @@ package adb
 
 import (
 	"bytes"
-	"fmt"
-	"log"
-	"os"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
 	"time"
 )
 
 const (
 	dalvikWarning = "WARNING: linker: libdvm.so has text relocations. This is wasting memory and is a security risk. Please fix."
+
+	// waitInterval is how long WaitForContext sleeps between attempts.
+	waitInterval = 250 * time.Millisecond
 )
 
 type Adb struct {
@@ -18,104 +22,146 @@ type Adb struct {
 }
 
 var (
-	Default = &Adb{Dialer{"localhost", 5037}, Any}
+	Default = &Adb{Dialer{Host: "localhost", Port: 5037}, Any}
 )
 
 func Connect(host string, port int) *Adb {
-	return &Adb{Dialer{host, port}, Any}
+	return &Adb{Dialer{Host: host, Port: port}, Any}
 }
 
-func Devices() []byte {
+func Devices() ([]byte, error) {
 	return Default.Devices()
 }
 
-func WaitFor(t Transporter) {
-	for {
-		conn, _ := t.Dial()
-		err := t.Transport(conn)
+func WaitFor(t Transporter) error {
+	return WaitForContext(context.Background(), t)
+}
 
+// WaitForContext blocks until the transport for t can be opened or ctx is
+// done, in which case the context error is returned. A device that is
+// missing, offline or unauthorized is waited for; any other refusal from the
+// server, such as ErrMoreThanOneDevice, is returned straight away.
+func WaitForContext(ctx context.Context, t Transporter) error {
+	for {
+		conn, err := dialTransport(ctx, t)
 		if err == nil {
-			return
+			conn.Close()
+			return nil
+		}
+		if !transient(err) {
+			return err
 		}
 
-		defer conn.Close()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(waitInterval):
+		}
 	}
 }
 
-func Log(t Transporter, args ...string) chan []byte {
-	out := make(chan []byte)
+// transient reports whether err may go away once a device finishes
+// connecting or is authorized.
+func transient(err error) bool {
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		return true
+	}
+	return errors.Is(err, ErrDeviceNotFound) || errors.Is(err, ErrDeviceOffline) || errors.Is(err, ErrUnauthorized)
+}
 
-	go func(out chan []byte) {
-		defer close(out)
-		conn, err := t.Dial()
+func Log(t Transporter, args ...string) (<-chan []byte, error) {
+	return LogContext(context.Background(), t, args...)
+}
 
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+// LogContext is like Log but stops reading and closes the channel once ctx
+// is done.
+func LogContext(ctx context.Context, t Transporter, args ...string) (<-chan []byte, error) {
+	conn, err := dialTransport(ctx, t)
+	if err != nil {
+		return nil, err
+	}
 
-		defer conn.Close()
+	err = conn.Log(args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
-		err = t.Transport(conn)
-		if err != nil {
-			fmt.Println("more than one device or emulator")
-			os.Exit(2)
-		}
-		conn.Log(args...)
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
+		defer conn.Close()
 
 		for {
 			line, _, err := conn.r.ReadLine()
 			if err != nil {
 				break
 			}
-			out <- line
+			select {
+			case out <- line:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}(out)
-	return out
+	}()
+	return out, nil
 }
 
-func Shell(t Transporter, args ...string) chan []byte {
-	out := make(chan []byte)
+func Shell(t Transporter, args ...string) (<-chan []byte, error) {
+	return ShellContext(context.Background(), t, args...)
+}
 
-	go func(out chan []byte) {
-		defer close(out)
-		conn, err := t.Dial()
+// ShellContext is like Shell but stops reading and closes the channel once
+// ctx is done.
+func ShellContext(ctx context.Context, t Transporter, args ...string) (<-chan []byte, error) {
+	conn, err := dialTransport(ctx, t)
+	if err != nil {
+		return nil, err
+	}
 
-		if err != nil {
-			fmt.Println(err)
-			return
-		}
+	err = conn.Shell(args...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
 
+	out := make(chan []byte)
+	go func() {
+		defer close(out)
 		defer conn.Close()
 
-		err = t.Transport(conn)
-		if err != nil {
-			fmt.Println(err)
-			fmt.Println("more than one device or emulator")
-			os.Exit(2)
-		}
-		conn.Shell(args...)
-
 		for {
 			line, _, err := conn.r.ReadLine()
-			line = bytes.Replace(line, []byte{'\r'}, []byte{}, 0)
 			if err != nil {
 				break
 			}
-			out <- line
+			line = bytes.Replace(line, []byte{'\r'}, []byte{}, -1)
+			select {
+			case out <- line:
+			case <-ctx.Done():
+				return
+			}
 		}
-	}(out)
-	return out
+	}()
+	return out, nil
+}
+
+func ShellSync(t Transporter, args ...string) ([]byte, error) {
+	return ShellSyncContext(context.Background(), t, args...)
 }
 
-func ShellSync(t Transporter, args ...string) []byte {
-	out := Shell(t, args...)
+func ShellSyncContext(ctx context.Context, t Transporter, args ...string) ([]byte, error) {
+	out, err := ShellContext(ctx, t, args...)
+	if err != nil {
+		return nil, err
+	}
 	output := make([]byte, 0)
 	for line := range out {
 		output = append(output, line...)
 		output = append(output, '\n')
 	}
-	return output
+	return output, ctx.Err()
 }
 
 func (a *Adb) Transport(conn *AdbConn) error {
@@ -129,106 +175,139 @@ func (a *Adb) Transport(conn *AdbConn) error {
 	}
 }
 
-func timeTrack(start time.Time, name string) {
-	elapsed := time.Since(start)
-	log.Printf("%s took %s", name, elapsed)
+// HostPrefix addresses the devices selected by Method in host requests.
+func (a *Adb) HostPrefix() string {
+	switch a.Method {
+	case Usb:
+		return "host-usb"
+	case Emulator:
+		return "host-local"
+	default:
+		return "host"
+	}
+}
+
+func Frame(t Transporter) ([]byte, error) {
+	return FrameContext(context.Background(), t)
 }
 
-func Frame(t Transporter) []byte {
-	conn, err := t.Dial()
+func FrameContext(ctx context.Context, t Transporter) ([]byte, error) {
+	conn, err := dialTransport(ctx, t)
 	if err != nil {
-		return []byte{}
+		return nil, err
 	}
 	defer conn.Close()
-	err = t.Transport(conn)
-	if err != nil {
-		fmt.Println(err)
-		fmt.Println("more than one device or emulator")
-		os.Exit(2)
-	}
 
 	_, err = conn.WriteCmd("framebuffer:")
+	if err != nil {
+		return nil, err
+	}
 
+	// Version 2 headers add the color space after the depth; the rest is
+	// size, width, height and offset and length of red, blue, green and
+	// alpha.
+	var version uint32
+	err = binary.Read(conn, binary.LittleEndian, &version)
+	if err != nil {
+		return nil, err
+	}
+	header, sizeIndex := make([]uint32, 12), 1
+	if version == 2 {
+		header, sizeIndex = make([]uint32, 13), 2
+	}
+	err = binary.Read(conn, binary.LittleEndian, header)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
+	size := header[sizeIndex]
 
-	version := conn.readUint32()
-	fmt.Printf("Version, %d\n", version)
-	depth := conn.readUint32()
-	fmt.Printf("Depth, %d\n", depth)
-	size := conn.readUint32()
-	fmt.Println("Size, ", size)
-	height := conn.readUint32()
-	fmt.Println("height, ", height)
-	width := conn.readUint32()
-	fmt.Println("width, ", width)
-	ro := conn.readUint32()
-	fmt.Println("ro, ", ro)
-	rl := conn.readUint32()
-	fmt.Println("rl ", rl)
-	bo := conn.readUint32()
-	fmt.Println("bo, ", bo)
-	bl := conn.readUint32()
-	fmt.Println("bl ", bl)
-	gro := conn.readUint32()
-	fmt.Println("gro, ", gro)
-	gl := conn.readUint32()
-	fmt.Println("gl ", gl)
-	ao := conn.readUint32()
-	fmt.Println("ao, ", ao)
-	al := conn.readUint32()
-	fmt.Println("al ", al)
-
-	var lines []byte
-	for i := 0; i < 3; i++ {
-		lines = conn.readImageBytes(size)
-		conn.Write([]byte{1})
+	pixels, err := conn.readImageBytes(size)
+	if err != nil {
+		return nil, err
 	}
-	return lines
+	return pixels, ctx.Err()
 }
 
-func (conn *AdbConn) readImageBytes(size uint32) []byte {
-	defer timeTrack(time.Now(), "readImageBytes")
-	lines := make([]byte, size)
-	w := bytes.NewBuffer(lines)
-	total, _ := w.ReadFrom(conn)
-	log.Println("PUlled ", total)
+func (conn *AdbConn) readImageBytes(size uint32) ([]byte, error) {
+	pixels := make([]byte, size)
+	_, err := io.ReadFull(conn, pixels)
+	return pixels, err
+}
 
-	return w.Bytes()
+// Screencap returns a PNG screenshot taken by screencap on the device.
+func Screencap(t Transporter) ([]byte, error) {
+	return ScreencapContext(context.Background(), t)
 }
 
-func (adb *Adb) Devices() []byte {
-	conn, err := adb.Dial()
+func ScreencapContext(ctx context.Context, t Transporter) ([]byte, error) {
+	conn, err := dialTransport(ctx, t)
 	if err != nil {
-		return []byte{}
+		return nil, err
 	}
 	defer conn.Close()
 
-	conn.WriteCmd("host:devices")
-	size, _ := conn.readSize(4)
+	// exec: keeps the PNG intact where the shell service would translate
+	// its line endings.
+	_, err = conn.WriteCmd("exec:screencap -p")
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return out, err
+}
+
+func (adb *Adb) Devices() ([]byte, error) {
+	return adb.DevicesContext(context.Background())
+}
+
+func (adb *Adb) DevicesContext(ctx context.Context) ([]byte, error) {
+	conn, err := adb.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteCmd("host:devices")
+	if err != nil {
+		return nil, err
+	}
+	size, err := conn.readSize(4)
+	if err != nil {
+		return nil, err
+	}
 
 	lines := make([]byte, size)
-	conn.Read(lines)
+	_, err = io.ReadFull(conn, lines)
+	return lines, err
+}
 
-	return lines
+func (adb *Adb) TrackDevices() (<-chan []byte, error) {
+	return adb.TrackDevicesContext(context.Background())
 }
 
-func (adb *Adb) TrackDevices() chan []byte {
+// TrackDevicesContext is like TrackDevices but closes the channel once ctx
+// is done.
+func (adb *Adb) TrackDevicesContext(ctx context.Context) (<-chan []byte, error) {
+	conn, err := adb.DialContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.WriteCmd("host:track-devices")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
 	out := make(chan []byte)
 	go func() {
 		defer close(out)
-
-		conn, err := adb.Dial()
-
-		if err != nil {
-			return
-		}
-
 		defer conn.Close()
 
-		conn.WriteCmd("host:track-devices")
-
 		for {
 			size, err := conn.readSize(4)
 			if err != nil {
@@ -236,37 +315,74 @@ func (adb *Adb) TrackDevices() chan []byte {
 			}
 
 			lines := make([]byte, size)
-			_, err = conn.Read(lines)
+			_, err = io.ReadFull(conn, lines)
 			if err != nil {
 				break
 			}
-			out <- lines
+			select {
+			case out <- lines:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
-	return out
+	return out, nil
+}
+
+// FindDevice returns the device with the given serial. It fails with
+// ErrDeviceNotFound if no such device is attached, and with ErrDeviceOffline
+// or ErrUnauthorized if the device cannot be used yet.
+func (adb *Adb) FindDevice(serial string) (Device, error) {
+	return adb.FindDeviceContext(context.Background(), serial)
 }
 
-func (adb *Adb) FindDevice(serial string) Device {
+// FindDeviceContext is like FindDevice but gives up once ctx is done. Only
+// the device found is updated, however many others are attached.
+func (adb *Adb) FindDeviceContext(ctx context.Context, serial string) (Device, error) {
 	var dev Device
-	devices := adb.FindDevices(serial)
-	if len(devices) > 0 {
-		dev = *devices[0]
+	infos, err := adb.DeviceListContext(ctx)
+	if err != nil {
+		return dev, err
+	}
+
+	for _, info := range infos {
+		if info.Serial != serial {
+			continue
+		}
+		switch info.State {
+		case StateDevice:
+			dev = Device{Dialer: adb.Dialer, Serial: serial, TransportID: info.TransportID}
+			return dev, dev.load(ctx)
+		case StateUnauthorized:
+			return dev, ErrUnauthorized
+		default:
+			return dev, ErrDeviceOffline
+		}
 	}
-	return dev
+	return dev, ErrDeviceNotFound
 }
 
-func (adb *Adb) FindDevices(serial ...string) []*Device {
+func (adb *Adb) FindDevices(serial ...string) ([]*Device, error) {
 	filter := &DeviceFilter{}
 	filter.Serials = serial
 	filter.MaxSdk = LATEST
 	return adb.ListDevices(filter)
 }
 
-func ListDevices(filter *DeviceFilter) []*Device {
+func ListDevices(filter *DeviceFilter) ([]*Device, error) {
 	return Default.ListDevices(filter)
 }
 
-func (adb *Adb) ListDevices(filter *DeviceFilter) []*Device {
-	output := adb.Devices()
-	return adb.ParseDevices(filter, output)
+func (adb *Adb) ListDevices(filter *DeviceFilter) ([]*Device, error) {
+	return adb.ListDevicesContext(context.Background(), filter)
+}
+
+// ListDevicesContext returns the online devices matching filter with their
+// properties loaded.
+func (adb *Adb) ListDevicesContext(ctx context.Context, filter *DeviceFilter) ([]*Device, error) {
+	infos, err := adb.DeviceListContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return adb.updateDevices(ctx, filter, infos)
 }
@@ -0,0 +1,89 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// refusingServer lists devices but refuses every other request with reason,
+// like a server whose devices were unplugged right after the listing.
+func refusingServer(t *testing.T, list, reason string) *Adb {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				size := make([]byte, 4)
+				if _, err := io.ReadFull(conn, size); err != nil {
+					return
+				}
+				n, _ := strconv.ParseUint(string(size), 16, 16)
+				req := make([]byte, n)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				if string(req) == "host:devices-l" {
+					fmt.Fprintf(conn, "OKAY%04x%s", len(list), list)
+					return
+				}
+				fmt.Fprintf(conn, "FAIL%04x%s", len(reason), reason)
+			}()
+		}
+	}()
+	return Connect("127.0.0.1", l.Addr().(*net.TCPAddr).Port)
+}
+
+func TestListDevicesLeavesOutRefusedDevices(t *testing.T) {
+	a := refusingServer(t, "gone device product:x model:x device:x transport_id:7\n", "device 'transport_id 7' not found")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	devices, err := a.ListDevicesContext(ctx, nil)
+	if err != nil || len(devices) != 0 {
+		t.Errorf("ListDevicesContext() = %d devices, %v, want none", len(devices), err)
+	}
+
+	_, err = a.FindDeviceContext(ctx, "gone")
+	if !errors.Is(err, ErrDeviceNotFound) {
+		t.Errorf("FindDeviceContext() error = %v, want ErrDeviceNotFound", err)
+	}
+}
+
+func TestWaitForPermanentError(t *testing.T) {
+	a := refusingServer(t, "", "more than one device/emulator")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	err := WaitForContext(ctx, &Device{Dialer: a.Dialer, Serial: "any"})
+	if !errors.Is(err, ErrMoreThanOneDevice) {
+		t.Errorf("WaitForContext() error = %v, want ErrMoreThanOneDevice", err)
+	}
+}
+
+func TestWaitForMissingDevice(t *testing.T) {
+	a := refusingServer(t, "", "device 'late' not found")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*waitInterval)
+	defer cancel()
+	err := WaitForContext(ctx, &Device{Dialer: a.Dialer, Serial: "late"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("WaitForContext() error = %v, want it to wait for the device", err)
+	}
+}
@@ -0,0 +1,449 @@
+package adbtest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wmbest2/android/adb"
+)
+
+// Shell v2 packet ids.
+const (
+	shellStdin      byte = 0
+	shellStdout     byte = 1
+	shellStderr     byte = 2
+	shellExit       byte = 3
+	shellCloseStdin byte = 4
+	shellWindowSize byte = 5
+)
+
+// EchoService is a socket on every device that echoes what it receives, for
+// testing streams opened with adb.DialService.
+const EchoService = "tcp:7"
+
+// legacyExitSuffix is what adb.ShellCommand appends to commands run over the
+// legacy shell service to learn their exit status.
+const legacyExitSuffix = " ; echo :ADB_EXIT:$?"
+
+type ShellResponse struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// ShellHandler answers a command run through shell: or exec:. stdin carries
+// the input sent by the client.
+type ShellHandler func(command string, stdin io.Reader) ShellResponse
+
+// Device is a fake device served by a Server. Its exported fields describe
+// it in host:devices-l and must be set before it is used.
+type Device struct {
+	Serial      string
+	TransportID int64
+	Product     string
+	Model       string
+	DeviceName  string
+
+	server *Server
+
+	mu          sync.Mutex
+	state       adb.DeviceState
+	props       map[string]string
+	featureList []adb.Feature
+	handlers    map[string]ShellHandler
+	files       map[string]*file
+	installs    [][]byte
+	windowSize  string
+	screen      [2]int
+	reverses    forwardTable
+	framebuffer framebuffer
+}
+
+type framebuffer struct {
+	width, height int
+	pixels        []byte
+}
+
+func newDevice(s *Server, serial string, id int64) *Device {
+	return &Device{
+		Serial:      serial,
+		TransportID: id,
+		Product:     "fake",
+		Model:       "Fake_Device",
+		DeviceName:  "fake",
+		server:      s,
+		state:       adb.StateDevice,
+		props: map[string]string{
+			"ro.serialno":              serial,
+			"ro.product.manufacturer":  "Fake",
+			"ro.product.model":         "Fake Device",
+			"ro.build.version.release": "14",
+			"ro.build.version.sdk":     "34",
+			"ro.sf.lcd_density":        "420",
+		},
+		featureList: []adb.Feature{adb.FeatureShellV2, adb.FeatureCmd},
+		screen:      [2]int{1080, 2400},
+		handlers:    map[string]ShellHandler{},
+		files:       map[string]*file{},
+	}
+}
+
+func (d *Device) State() adb.DeviceState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state
+}
+
+// refusal returns the reason the real server would refuse to reach d, or ""
+// when d is online.
+func (d *Device) refusal() string {
+	switch d.State() {
+	case adb.StateDevice:
+		return ""
+	case adb.StateUnauthorized:
+		return "device unauthorized.\nThis adb server's $ADB_VENDOR_KEYS is not set"
+	}
+	return "device offline"
+}
+
+// SetState changes the state reported for the device, e.g. to
+// adb.StateOffline. Transports to a device that is not online fail.
+func (d *Device) SetState(state adb.DeviceState) {
+	d.mu.Lock()
+	d.state = state
+	d.mu.Unlock()
+	d.server.notify()
+}
+
+func (d *Device) SetProp(key, value string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.props[key] = value
+}
+
+// SetScreenSize sets the size in pixels reported by "wm size". Together with
+// ro.sf.lcd_density it decides whether clients see a phone or a tablet.
+func (d *Device) SetScreenSize(width, height int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.screen = [2]int{width, height}
+}
+
+// SetFeatures replaces the features the device reports. Dropping
+// adb.FeatureShellV2 makes clients fall back to the legacy shell service.
+func (d *Device) SetFeatures(features ...adb.Feature) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.featureList = features
+}
+
+func (d *Device) features() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return joinFeatures(d.featureList)
+}
+
+// HandleShell answers command with h. A command ending in "*" matches every
+// command starting with the rest of it; exact matches win.
+func (d *Device) HandleShell(command string, h ShellHandler) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.handlers[command] = h
+}
+
+// RespondShell answers command with a canned response.
+func (d *Device) RespondShell(command string, resp ShellResponse) {
+	d.HandleShell(command, func(string, io.Reader) ShellResponse {
+		return resp
+	})
+}
+
+// SetFramebuffer sets the RGBA pixels served by framebuffer:.
+func (d *Device) SetFramebuffer(width, height int, pixels []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.framebuffer = framebuffer{width: width, height: height, pixels: pixels}
+}
+
+// Installs returns the APKs streamed to "cmd package install", oldest first.
+func (d *Device) Installs() [][]byte {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([][]byte(nil), d.installs...)
+}
+
+// WindowSize returns the last terminal size sent by a shell v2 session,
+// e.g. "24x80,0x0".
+func (d *Device) WindowSize() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.windowSize
+}
+
+func (d *Device) handler(command string) ShellHandler {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if h, ok := d.handlers[command]; ok {
+		return h
+	}
+	best := ""
+	var found ShellHandler
+	for pattern, h := range d.handlers {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(command, prefix) && len(prefix) >= len(best) {
+			best, found = prefix, h
+		}
+	}
+	return found
+}
+
+// run answers command with a registered handler or one of the built in
+// commands.
+func (d *Device) run(command string, stdin io.Reader) ShellResponse {
+	command = strings.TrimSpace(command)
+	if h := d.handler(command); h != nil {
+		return h(command, stdin)
+	}
+
+	args := strings.Fields(command)
+	if len(args) == 0 {
+		return ShellResponse{}
+	}
+	switch args[0] {
+	case "getprop":
+		return d.getprop(args[1:])
+	case "echo":
+		return ShellResponse{Stdout: strings.Join(args[1:], " ") + "\n"}
+	case "cat":
+		return d.cat(args[1:])
+	case "rm":
+		return d.rm(args[1:])
+	case "wm":
+		if len(args) == 2 && args[1] == "size" {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return ShellResponse{Stdout: fmt.Sprintf("Physical size: %dx%d\n", d.screen[0], d.screen[1])}
+		}
+	case "cmd":
+		if len(args) > 2 && args[1] == "package" && args[2] == "install" {
+			return d.install(args, stdin)
+		}
+	}
+	return ShellResponse{Stderr: "/system/bin/sh: " + args[0] + ": inaccessible or not found\n", ExitCode: 127}
+}
+
+func (d *Device) getprop(args []string) ShellResponse {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(args) > 0 {
+		return ShellResponse{Stdout: d.props[unquote(args[0])] + "\n"}
+	}
+
+	keys := make([]string, 0, len(d.props))
+	for k := range d.props {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, "[%s]: [%s]\n", k, d.props[k])
+	}
+	return ShellResponse{Stdout: b.String()}
+}
+
+func (d *Device) cat(args []string) ShellResponse {
+	var out bytes.Buffer
+	for _, name := range args {
+		data, ok := d.ReadFile(unquote(name))
+		if !ok {
+			return ShellResponse{Stdout: out.String(), Stderr: "cat: " + name + ": No such file or directory\n", ExitCode: 1}
+		}
+		out.Write(data)
+	}
+	return ShellResponse{Stdout: out.String()}
+}
+
+func (d *Device) rm(args []string) ShellResponse {
+	for _, name := range args {
+		if strings.HasPrefix(name, "-") {
+			continue
+		}
+		d.RemoveFile(unquote(name))
+	}
+	return ShellResponse{}
+}
+
+// install reads the APK of "cmd package install -S size" from stdin.
+func (d *Device) install(args []string, stdin io.Reader) ShellResponse {
+	size := -1
+	for i, arg := range args {
+		if arg == "-S" && i+1 < len(args) {
+			size, _ = strconv.Atoi(args[i+1])
+		}
+	}
+	if size < 0 {
+		return ShellResponse{Stdout: "Failure [INSTALL_FAILED_INVALID_APK: fake only supports -S]\n"}
+	}
+
+	apk := make([]byte, size)
+	_, err := io.ReadFull(stdin, apk)
+	if err != nil {
+		return ShellResponse{Stdout: "Failure [INSTALL_FAILED_INVALID_APK: short read]\n"}
+	}
+
+	d.mu.Lock()
+	d.installs = append(d.installs, apk)
+	d.mu.Unlock()
+	return ShellResponse{Stdout: "Success\n"}
+}
+
+// serve answers a device service on a connection switched to d.
+func (d *Device) serve(c *clientConn, req string) {
+	switch {
+	case strings.HasPrefix(req, "shell,"):
+		_, command, _ := strings.Cut(req, ":")
+		options, _, _ := strings.Cut(strings.TrimPrefix(req, "shell,"), ":")
+		options = "," + options + ","
+		if !strings.Contains(options, ",v2,") {
+			d.shell(c, command)
+			return
+		}
+		d.shellV2(c, command, strings.Contains(options, ",pty,"))
+	case strings.HasPrefix(req, "shell:"):
+		d.shell(c, strings.TrimPrefix(req, "shell:"))
+	case strings.HasPrefix(req, "exec:"):
+		c.okay()
+		resp := d.run(strings.TrimPrefix(req, "exec:"), c.r)
+		io.WriteString(c, resp.Stdout)
+	case req == "sync:":
+		c.okay()
+		d.sync(c)
+	case req == EchoService:
+		// Echo whatever the client sends until it hangs up.
+		c.okay()
+		io.Copy(c, c.r)
+	case strings.HasPrefix(req, "reverse:"):
+		d.reverse(c, strings.TrimPrefix(req, "reverse:"))
+	case req == "framebuffer:":
+		c.okay()
+		d.writeFramebuffer(c)
+	default:
+		c.fail("unknown service " + req)
+	}
+}
+
+// shell runs a command over the legacy shell service, which merges stderr
+// into stdout, translates line endings and has no exit status.
+func (d *Device) shell(c *clientConn, command string) {
+	c.okay()
+
+	legacyExit := strings.HasSuffix(command, legacyExitSuffix)
+	command = strings.TrimSuffix(command, legacyExitSuffix)
+	resp := d.run(command, strings.NewReader(""))
+
+	out := resp.Stdout + resp.Stderr
+	if legacyExit {
+		out += fmt.Sprintf(":ADB_EXIT:%d\n", resp.ExitCode)
+	}
+	io.WriteString(c, strings.Replace(out, "\n", "\r\n", -1))
+}
+
+// shellV2 runs a command over shell v2. Stdin packets are passed on to the
+// handler until the client closes its input. With pty, stderr is merged into
+// stdout as it would be on a terminal.
+func (d *Device) shellV2(c *clientConn, command string, pty bool) {
+	c.okay()
+
+	stdin, w := io.Pipe()
+	go func() {
+		for {
+			id, data, err := readPacket(c.r)
+			if err != nil {
+				w.CloseWithError(err)
+				return
+			}
+			switch id {
+			case shellStdin:
+				w.Write(data)
+			case shellCloseStdin:
+				w.Close()
+			case shellWindowSize:
+				d.mu.Lock()
+				d.windowSize = strings.TrimSuffix(string(data), "\x00")
+				d.mu.Unlock()
+			}
+		}
+	}()
+
+	resp := d.run(command, stdin)
+	stdin.Close()
+	if pty {
+		resp.Stdout, resp.Stderr = resp.Stdout+resp.Stderr, ""
+	}
+	if resp.Stdout != "" {
+		writePacket(c, shellStdout, []byte(resp.Stdout))
+	}
+	if resp.Stderr != "" {
+		writePacket(c, shellStderr, []byte(resp.Stderr))
+	}
+	writePacket(c, shellExit, []byte{byte(resp.ExitCode)})
+}
+
+func readPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+	data := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	_, err = io.ReadFull(r, data)
+	return header[0], data, err
+}
+
+func writePacket(w io.Writer, id byte, data []byte) error {
+	packet := make([]byte, 5+len(data))
+	packet[0] = id
+	binary.LittleEndian.PutUint32(packet[1:], uint32(len(data)))
+	copy(packet[5:], data)
+	_, err := w.Write(packet)
+	return err
+}
+
+// writeFramebuffer sends a version 1 framebuffer header for 32 bit RGBA
+// followed by the pixels.
+func (d *Device) writeFramebuffer(w io.Writer) {
+	d.mu.Lock()
+	fb := d.framebuffer
+	d.mu.Unlock()
+
+	header := []uint32{
+		1,                      // version
+		32,                     // bits per pixel
+		uint32(len(fb.pixels)), // size
+		uint32(fb.width),
+		uint32(fb.height),
+		0, 8, // red offset and length
+		16, 8, // blue
+		8, 8, // green
+		24, 8, // alpha
+	}
+	binary.Write(w, binary.LittleEndian, header)
+	w.Write(fb.pixels)
+}
+
+// unquote strips the single quotes adb adds around shell arguments.
+func unquote(s string) string {
+	if len(s) >= 2 && s[0] == '\'' && s[len(s)-1] == '\'' {
+		return strings.Replace(s[1:len(s)-1], `'\''`, "'", -1)
+	}
+	return s
+}
@@ -0,0 +1,133 @@
+package adbtest
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// firstPort is the first port handed out for tcp:0.
+const firstPort = 40000
+
+// forward is an entry of a forward or reverse list. No sockets are opened
+// for it.
+type forward struct {
+	serial string
+	listen string
+	target string
+}
+
+type forwardTable struct {
+	mu      sync.Mutex
+	entries []forward
+}
+
+// add installs f, replacing a forward of the same socket unless noRebind.
+// It returns why the real server would refuse it, or "".
+func (t *forwardTable) add(f forward, noRebind bool) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, e := range t.entries {
+		if e.listen != f.listen {
+			continue
+		}
+		if noRebind {
+			return "cannot rebind existing socket"
+		}
+		t.entries[i] = f
+		return ""
+	}
+	t.entries = append(t.entries, f)
+	return ""
+}
+
+// remove drops the forward of listen, or every forward when listen is "".
+func (t *forwardTable) remove(listen string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if listen == "" {
+		t.entries = nil
+		return ""
+	}
+	for i, e := range t.entries {
+		if e.listen == listen {
+			t.entries = append(t.entries[:i], t.entries[i+1:]...)
+			return ""
+		}
+	}
+	return "listener '" + listen + "' not found"
+}
+
+// list formats the table like host:list-forward.
+func (t *forwardTable) list() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b strings.Builder
+	for _, e := range t.entries {
+		fmt.Fprintf(&b, "%s %s %s\n", e.serial, e.listen, e.target)
+	}
+	return b.String()
+}
+
+// forward answers "[norebind:]listen;target" for table the way the real
+// server does: OKAY twice and, for tcp:0, the port it picked.
+func (s *Server) forward(c *clientConn, table *forwardTable, serial, spec string) {
+	spec, noRebind := strings.CutPrefix(spec, "norebind:")
+	listen, target, ok := strings.Cut(spec, ";")
+	if !ok || listen == "" || target == "" {
+		c.fail("malformed forward spec '" + spec + "'")
+		return
+	}
+
+	port := ""
+	if listen == "tcp:0" {
+		s.mu.Lock()
+		s.nextPort++
+		port = fmt.Sprint(firstPort + s.nextPort)
+		s.mu.Unlock()
+		listen = "tcp:" + port
+	}
+
+	c.okay()
+	if msg := table.add(forward{serial: serial, listen: listen, target: target}, noRebind); msg != "" {
+		c.fail(msg)
+		return
+	}
+	c.okay()
+	if port != "" {
+		fmt.Fprintf(c, "%04x%s", len(port), port)
+	}
+}
+
+// killForward answers a request to remove the forward of listen, or all of
+// them when listen is "".
+func (s *Server) killForward(c *clientConn, table *forwardTable, listen string) {
+	c.okay()
+	if msg := table.remove(listen); msg != "" {
+		c.fail(msg)
+		return
+	}
+	c.okay()
+}
+
+// reverse answers a reverse: service on a connection switched to d. The
+// connection is then left open until the client closes it, so that clients
+// cannot count on the server hanging up.
+func (d *Device) reverse(c *clientConn, req string) {
+	s := d.server
+	switch {
+	case strings.HasPrefix(req, "forward:"):
+		s.forward(c, &d.reverses, "host", strings.TrimPrefix(req, "forward:"))
+	case strings.HasPrefix(req, "killforward:"):
+		s.killForward(c, &d.reverses, strings.TrimPrefix(req, "killforward:"))
+	case req == "killforward-all":
+		s.killForward(c, &d.reverses, "")
+	case req == "list-forward":
+		c.okayString(d.reverses.list())
+	default:
+		c.fail("unknown reverse service " + req)
+		return
+	}
+	io.Copy(io.Discard, c.r)
+}
@@ -0,0 +1,90 @@
+package adbtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+)
+
+func TestForward(t *testing.T) {
+	s, _, d := start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	picked, err := d.ForwardContext(ctx, "tcp:0", "localabstract:chrome_devtools_remote", false)
+	if err != nil || picked == 0 {
+		t.Fatalf("Forward(tcp:0) = %d, %v", picked, err)
+	}
+	// The fake leaves the connection open, so reading a port that is never
+	// sent would only end at the deadline.
+	port, err := d.ForwardContext(ctx, "tcp:6000", "tcp:7000", false)
+	if err != nil || port != 6000 || ctx.Err() != nil {
+		t.Fatalf("Forward(tcp:6000) = %d, %v, %v", port, err, ctx.Err())
+	}
+	_, err = d.ForwardContext(ctx, "tcp:6000", "tcp:7001", true)
+	if err == nil {
+		t.Error("Forward() with noRebind replaced an existing forward")
+	}
+
+	forwards, err := d.ListForwardsContext(ctx)
+	if err != nil || len(forwards) != 2 {
+		t.Fatalf("ListForwards() = %v, %v", forwards, err)
+	}
+	want := adb.Forward{Serial: "emulator-5554", Local: "tcp:6000", Remote: "tcp:7000"}
+	if forwards[1] != want {
+		t.Errorf("forward = %+v, want %+v", forwards[1], want)
+	}
+
+	err = d.RemoveForwardContext(ctx, "tcp:6000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RemoveForwardContext(ctx, "tcp:6000"); err == nil {
+		t.Error("RemoveForward() of a removed forward succeeded")
+	}
+	err = d.RemoveAllForwardsContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forwards, _ := s.Adb().ListForwardsContext(ctx); len(forwards) != 0 {
+		t.Errorf("forwards left: %v", forwards)
+	}
+}
+
+func TestReverse(t *testing.T) {
+	_, _, d := start(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	picked, err := d.ReverseContext(ctx, "tcp:0", "tcp:8080", false)
+	if err != nil || picked == 0 {
+		t.Fatalf("Reverse(tcp:0) = %d, %v", picked, err)
+	}
+	port, err := d.ReverseContext(ctx, "tcp:9000", "tcp:8080", false)
+	if err != nil || port != 9000 || ctx.Err() != nil {
+		t.Fatalf("Reverse(tcp:9000) = %d, %v, %v", port, err, ctx.Err())
+	}
+
+	reverses, err := d.ListReversesContext(ctx)
+	if err != nil || len(reverses) != 2 {
+		t.Fatalf("ListReverses() = %v, %v", reverses, err)
+	}
+	want := adb.Forward{Serial: "emulator-5554", Remote: "tcp:9000", Local: "tcp:8080"}
+	if reverses[1] != want {
+		t.Errorf("reverse = %+v, want %+v", reverses[1], want)
+	}
+
+	err = d.RemoveReverseContext(ctx, "tcp:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = d.RemoveAllReversesContext(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reverses, _ := d.ListReversesContext(ctx); len(reverses) != 0 {
+		t.Errorf("reverses left: %v", reverses)
+	}
+}
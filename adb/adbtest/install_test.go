@@ -0,0 +1,107 @@
+package adbtest_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+func writeAPK(t *testing.T, name string, data []byte) string {
+	t.Helper()
+	apk := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(apk, data, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return apk
+}
+
+func TestInstallStreamed(t *testing.T) {
+	_, fake, d := start(t)
+	data := bytes.Repeat([]byte("apk"), 30000)
+	apk := writeAPK(t, "app.apk", data)
+
+	result, err := d.Install(apk, nil)
+	if err != nil || !result.Success {
+		t.Fatalf("Install() = %+v, %v", result, err)
+	}
+	installs := fake.Installs()
+	if len(installs) != 1 || !bytes.Equal(installs[0], data) {
+		t.Errorf("device received %d installs", len(installs))
+	}
+}
+
+func TestInstallFailure(t *testing.T) {
+	_, fake, d := start(t)
+	fake.RespondShell("cmd package install*", adbtest.ShellResponse{
+		Stdout: "Failure [INSTALL_FAILED_VERSION_DOWNGRADE: Downgrade detected]\n",
+	})
+	apk := writeAPK(t, "app.apk", []byte("apk"))
+
+	result, err := d.Install(apk, nil)
+	var installErr *adb.InstallError
+	if !errors.As(err, &installErr) {
+		t.Fatalf("Install() error = %v, want an *InstallError", err)
+	}
+	if result.Success || result.Code != "INSTALL_FAILED_VERSION_DOWNGRADE" {
+		t.Errorf("Install() = %+v", result)
+	}
+}
+
+func TestInstallLegacy(t *testing.T) {
+	_, fake, d := start(t)
+	fake.SetFeatures()
+
+	// pm reads the pushed APK, so it must arrive readable.
+	var pushed []byte
+	fake.HandleShell("pm install*", func(command string, stdin io.Reader) adbtest.ShellResponse {
+		remote := strings.Trim(command[strings.LastIndex(command, " ")+1:], "'")
+		mode, _ := fake.FileMode(remote)
+		if mode&0444 != 0444 {
+			return adbtest.ShellResponse{Stdout: "Failure [INSTALL_FAILED_INVALID_APK: unreadable]\n"}
+		}
+		pushed, _ = fake.ReadFile(remote)
+		return adbtest.ShellResponse{Stdout: "Success\n"}
+	})
+	apk := writeAPK(t, "app.apk", []byte("legacy apk"))
+
+	result, err := d.Install(apk, &adb.InstallOptions{Replace: true})
+	if err != nil || !result.Success {
+		t.Fatalf("Install() = %+v, %v", result, err)
+	}
+	if string(pushed) != "legacy apk" {
+		t.Errorf("pm saw %q", pushed)
+	}
+	if _, ok := fake.ReadFile("/data/local/tmp/app.apk"); ok {
+		t.Error("the pushed APK was not removed")
+	}
+}
+
+func TestInstallToDevices(t *testing.T) {
+	s, fake, d := start(t)
+	broken := s.AddDevice("emulator-5556")
+	broken.RespondShell("cmd package install*", adbtest.ShellResponse{Stdout: "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]\n"})
+	d2, err := s.Adb().FindDevice("emulator-5556")
+	if err != nil {
+		t.Fatal(err)
+	}
+	apk := writeAPK(t, "app.apk", []byte("apk"))
+
+	results := adb.InstallToDevices([]*adb.Device{d, &d2}, apk, &adb.InstallOptions{Parallelism: 1})
+	if len(results) != 2 {
+		t.Fatalf("got %d results", len(results))
+	}
+	if results[0].Err != nil || len(fake.Installs()) != 1 {
+		t.Errorf("device 0: %v", results[0].Err)
+	}
+	if results[1].Err == nil || results[1].Result.Code != "INSTALL_FAILED_INSUFFICIENT_STORAGE" {
+		t.Errorf("device 1: %+v, %v", results[1].Result, results[1].Err)
+	}
+}
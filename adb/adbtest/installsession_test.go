@@ -0,0 +1,32 @@
+package adbtest_test
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+func TestInstallMultipleLegacy(t *testing.T) {
+	_, fake, d := start(t)
+	fake.SetFeatures()
+	fake.RespondShell("pm install-create*", adbtest.ShellResponse{Stdout: "Success: created install session [42]\n"})
+	fake.RespondShell("pm install-commit 42", adbtest.ShellResponse{Stdout: "Success\n"})
+
+	var written []string
+	fake.HandleShell("pm install-write*", func(command string, stdin io.Reader) adbtest.ShellResponse {
+		written = append(written, strings.Trim(strings.Fields(command)[5], "'"))
+		return adbtest.ShellResponse{Stdout: "Success: streamed 3 bytes\n"}
+	})
+	base := writeAPK(t, "base.apk", []byte("base"))
+	split := writeAPK(t, "split_config.en.apk", []byte("split"))
+
+	result, err := d.InstallMultiple([]string{base, split}, nil)
+	if err != nil || !result.Success {
+		t.Fatalf("InstallMultiple() = %+v, %v", result, err)
+	}
+	if strings.Join(written, " ") != "base.apk split_config.en.apk" {
+		t.Errorf("install-write got %v", written)
+	}
+}
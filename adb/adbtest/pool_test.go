@@ -0,0 +1,86 @@
+package adbtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+)
+
+func TestAcquireWaitsForRelease(t *testing.T) {
+	s, _, _ := start(t)
+	store, err := adb.NewFileLockStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	first := &adb.DevicePool{Adb: s.Adb(), Store: store, TTL: 60 * time.Millisecond, PollInterval: 10 * time.Millisecond}
+	leases, err := first.Acquire(ctx, nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second := &adb.DevicePool{Adb: s.Adb(), Store: store, PollInterval: 10 * time.Millisecond}
+	acquired := make(chan []*adb.Lease, 1)
+	go func() {
+		leases, err := second.Acquire(ctx, nil, 1)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- leases
+	}()
+
+	// The held lease is renewed well past its TTL.
+	select {
+	case <-acquired:
+		t.Fatal("Acquire() took a leased device")
+	case <-leases[0].Lost():
+		t.Fatalf("lease lost: %v", leases[0].Err())
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	err = leases[0].Release()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-acquired:
+		if len(got) != 1 || got[0].Device.Serial != "emulator-5554" {
+			t.Errorf("Acquire() after Release() = %v", got)
+		}
+		adb.ReleaseAll(got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Acquire() still blocked after Release()")
+	}
+}
+
+func TestLeaseLost(t *testing.T) {
+	s, _, _ := start(t)
+	store := adb.NewMemoryLockStore()
+
+	pool := &adb.DevicePool{Adb: s.Adb(), Store: store, Owner: "a", TTL: 30 * time.Millisecond}
+	leases, err := pool.Acquire(context.Background(), nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer adb.ReleaseAll(leases)
+
+	// Someone else takes the device over, as after a stall past the TTL.
+	store.Unlock("emulator-5554", "a")
+	ok, _ := store.TryLock("emulator-5554", "b", time.Hour)
+	if !ok {
+		t.Fatal("TryLock() failed")
+	}
+
+	select {
+	case <-leases[0].Lost():
+		if leases[0].Err() != adb.ErrLeaseLost {
+			t.Errorf("Err() = %v, want ErrLeaseLost", leases[0].Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("lease not lost")
+	}
+}
@@ -0,0 +1,84 @@
+package adbtest_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+func TestRecordReplay(t *testing.T) {
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake := s.AddDevice("emulator-5554")
+	s.AddDevice("emulator-5556")
+	fake.RespondShell("whoami", adbtest.ShellResponse{Stdout: "shell\n"})
+	fake.WriteFile("/sdcard/a.txt", []byte("hello"), 0644)
+
+	session := func(a *adb.Adb) (string, string) {
+		t.Helper()
+		devices, err := a.ListDevices(nil)
+		if err != nil || len(devices) != 2 {
+			t.Fatalf("ListDevices() = %v, %v", devices, err)
+		}
+		out, err := adb.Command(devices[0], "whoami").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = adb.Pull(devices[0], &buf, "/sdcard/a.txt")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out), buf.String()
+	}
+
+	var recording bytes.Buffer
+	r := adb.NewRecorder(&recording)
+	whoami, file := session(&adb.Adb{Dialer: r.Dialer(s.Dialer())})
+	if r.Err() != nil {
+		t.Fatal(r.Err())
+	}
+	s.Close()
+
+	p, err := adb.NewReplayer(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	replayedWhoami, replayedFile := session(&adb.Adb{Dialer: p.Dialer()})
+	if replayedWhoami != whoami || replayedFile != file {
+		t.Errorf("replay returned %q and %q, want %q and %q", replayedWhoami, replayedFile, whoami, file)
+	}
+	if err := p.Err(); err != nil {
+		t.Errorf("Err() = %v", err)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddDevice("emulator-5554")
+
+	var recording bytes.Buffer
+	r := adb.NewRecorder(&recording)
+	_, err = (&adb.Adb{Dialer: r.Dialer(s.Dialer())}).ServerVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := adb.NewReplayer(bytes.NewReader(recording.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&adb.Adb{Dialer: p.Dialer()}).DeviceList()
+	if !errors.Is(err, adb.ErrReplayMismatch) {
+		t.Errorf("DeviceList() error = %v, want ErrReplayMismatch", err)
+	}
+}
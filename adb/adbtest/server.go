@@ -0,0 +1,442 @@
+// Package adbtest provides a fake adb server for tests. It speaks the
+// smart-socket protocol on a local port and serves scripted devices with
+// properties, canned shell responses and an in-memory filesystem.
+//
+//	s, err := adbtest.NewServer()
+//	...
+//	defer s.Close()
+//	d := s.AddDevice("emulator-5554")
+//	d.SetProp("ro.build.version.sdk", "30")
+//	d.HandleShell("whoami", adbtest.ShellResponse{Stdout: "shell\n"})
+//	devices, err := s.Adb().ListDevices(nil)
+package adbtest
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/wmbest2/android/adb"
+)
+
+// DEFAULT_VERSION is the protocol version reported by host:version.
+const DEFAULT_VERSION = 41
+
+type Server struct {
+	// Version is reported by host:version.
+	Version int
+	// Features are the host features reported by host:features. Setting it
+	// to nil makes the server refuse feature requests, including those for a
+	// device, like servers that predate feature negotiation.
+	Features []adb.Feature
+
+	listener net.Listener
+	port     int
+	forwards forwardTable
+
+	mu       sync.Mutex
+	devices  []*Device
+	nextID   int64
+	nextPort int
+	changed  chan struct{}
+	conns    map[net.Conn]bool
+	closed   bool
+}
+
+// NewServer starts a fake server on a free local port.
+func NewServer() (*Server, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		Version:  DEFAULT_VERSION,
+		Features: []adb.Feature{adb.FeatureShellV2, adb.FeatureCmd},
+		listener: l,
+		port:     l.Addr().(*net.TCPAddr).Port,
+		changed:  make(chan struct{}),
+		conns:    map[net.Conn]bool{},
+	}
+	go s.accept()
+	return s, nil
+}
+
+// Dialer reaches the fake server.
+func (s *Server) Dialer() adb.Dialer {
+	return adb.Dialer{Host: "127.0.0.1", Port: s.port}
+}
+
+// Adb returns a client of the fake server.
+func (s *Server) Adb() *adb.Adb {
+	return adb.Connect("127.0.0.1", s.port)
+}
+
+// Close stops the server and drops every open connection.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	return s.listener.Close()
+}
+
+// AddDevice registers an online device with default properties.
+func (s *Server) AddDevice(serial string) *Device {
+	s.mu.Lock()
+	s.nextID++
+	d := newDevice(s, serial, s.nextID)
+	s.devices = append(s.devices, d)
+	s.mu.Unlock()
+
+	s.notify()
+	return d
+}
+
+// RemoveDevice disconnects the device with the given serial.
+func (s *Server) RemoveDevice(serial string) {
+	s.mu.Lock()
+	for i, d := range s.devices {
+		if d.Serial == serial {
+			s.devices = append(s.devices[:i], s.devices[i+1:]...)
+			break
+		}
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// notify wakes up every host:track-devices connection.
+func (s *Server) notify() {
+	s.mu.Lock()
+	close(s.changed)
+	s.changed = make(chan struct{})
+	s.mu.Unlock()
+}
+
+func (s *Server) findSerial(serial string) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.Serial == serial {
+			return d
+		}
+	}
+	return nil
+}
+
+// findPrefix finds the device whose serial prefixes req. Serials such as
+// 10.0.0.2:5555 contain colons, so req cannot simply be cut at the first.
+func (s *Server) findPrefix(req string) (*Device, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if strings.HasPrefix(req, d.Serial+":") {
+			return d, strings.TrimPrefix(req, d.Serial+":")
+		}
+	}
+	return nil, ""
+}
+
+func (s *Server) findID(id int64) *Device {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.devices {
+		if d.TransportID == id {
+			return d
+		}
+	}
+	return nil
+}
+
+// deviceList formats the devices like host:devices or, with long,
+// host:devices-l.
+func (s *Server) deviceList(long bool) string {
+	s.mu.Lock()
+	devices := append([]*Device(nil), s.devices...)
+	s.mu.Unlock()
+
+	var b strings.Builder
+	for _, d := range devices {
+		d.mu.Lock()
+		if long {
+			fmt.Fprintf(&b, "%-22s %s product:%s model:%s device:%s transport_id:%d\n",
+				d.Serial, d.state, d.Product, d.Model, d.DeviceName, d.TransportID)
+		} else {
+			fmt.Fprintf(&b, "%s\t%s\n", d.Serial, d.state)
+		}
+		d.mu.Unlock()
+	}
+	return b.String()
+}
+
+func (s *Server) accept() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+
+		go func() {
+			defer func() {
+				s.mu.Lock()
+				delete(s.conns, conn)
+				s.mu.Unlock()
+				conn.Close()
+			}()
+			s.serve(&clientConn{Conn: conn, r: bufio.NewReader(conn)})
+		}()
+	}
+}
+
+// clientConn is one client connection.
+type clientConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *clientConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *clientConn) readRequest() (string, error) {
+	size := make([]byte, 4)
+	_, err := io.ReadFull(c.r, size)
+	if err != nil {
+		return "", err
+	}
+	n, err := strconv.ParseUint(string(size), 16, 16)
+	if err != nil {
+		return "", err
+	}
+	req := make([]byte, n)
+	_, err = io.ReadFull(c.r, req)
+	return string(req), err
+}
+
+func (c *clientConn) okay() error {
+	_, err := io.WriteString(c, "OKAY")
+	return err
+}
+
+func (c *clientConn) fail(msg string) error {
+	_, err := fmt.Fprintf(c, "FAIL%04x%s", len(msg), msg)
+	return err
+}
+
+// okayString answers OKAY followed by a length-prefixed string.
+func (c *clientConn) okayString(s string) error {
+	_, err := fmt.Fprintf(c, "OKAY%04x%s", len(s), s)
+	return err
+}
+
+// serve reads host requests until one switches the connection to a device
+// service.
+func (s *Server) serve(c *clientConn) {
+	for {
+		req, err := c.readRequest()
+		if err != nil {
+			return
+		}
+
+		d, ok := s.host(c, req)
+		if !ok {
+			return
+		}
+		if d == nil {
+			continue
+		}
+
+		req, err = c.readRequest()
+		if err != nil {
+			return
+		}
+		d.serve(c, req)
+		return
+	}
+}
+
+// host answers a host request. It returns the device a transport request
+// selected, and false once the connection is done.
+func (s *Server) host(c *clientConn, req string) (*Device, bool) {
+	var target *Device
+	var service string
+	switch {
+	case strings.HasPrefix(req, "host:"):
+		service = strings.TrimPrefix(req, "host:")
+	case strings.HasPrefix(req, "host-usb:"), strings.HasPrefix(req, "host-local:"):
+		_, service, _ = strings.Cut(req, ":")
+		d, msg := s.any()
+		if d == nil {
+			c.fail(msg)
+			return nil, false
+		}
+		target = d
+	case strings.HasPrefix(req, "host-transport-id:"):
+		rest := strings.TrimPrefix(req, "host-transport-id:")
+		idStr, svc, _ := strings.Cut(rest, ":")
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		target, service = s.findID(id), svc
+		if target == nil {
+			c.fail("device 'transport_id " + idStr + "' not found")
+			return nil, false
+		}
+	case strings.HasPrefix(req, "host-serial:"):
+		rest := strings.TrimPrefix(req, "host-serial:")
+		target, service = s.findPrefix(rest)
+		if target == nil {
+			serial, _, _ := strings.Cut(rest, ":")
+			c.fail("device '" + serial + "' not found")
+			return nil, false
+		}
+	default:
+		c.fail("unknown host service")
+		return nil, false
+	}
+
+	switch {
+	case service == "version":
+		c.okayString(fmt.Sprintf("%04x", s.Version))
+	case service == "devices", service == "devices-l":
+		c.okayString(s.deviceList(service == "devices-l"))
+	case service == "track-devices", service == "track-devices-l":
+		s.track(c, service == "track-devices-l")
+	case service == "features" && s.Features == nil:
+		c.fail("unknown host service " + service)
+	case service == "features" && target != nil && target.refusal() != "":
+		c.fail(target.refusal())
+	case service == "features":
+		if target != nil {
+			c.okayString(target.features())
+		} else {
+			c.okayString(joinFeatures(s.Features))
+		}
+	case service == "get-state" && target != nil:
+		c.okayString(string(target.State()))
+	case service == "get-serialno" && target != nil:
+		c.okayString(target.Serial)
+	case service == "kill":
+		c.okay()
+	case strings.HasPrefix(service, "forward:") && target != nil:
+		// The connection is left open, so that clients cannot count on the
+		// server hanging up.
+		s.forward(c, &s.forwards, target.Serial, strings.TrimPrefix(service, "forward:"))
+		return nil, true
+	case strings.HasPrefix(service, "killforward:") && target != nil:
+		s.killForward(c, &s.forwards, strings.TrimPrefix(service, "killforward:"))
+	case service == "killforward-all":
+		s.killForward(c, &s.forwards, "")
+	case service == "list-forward":
+		c.okayString(s.forwards.list())
+	case strings.HasPrefix(service, "transport"):
+		d, msg := s.transport(strings.TrimPrefix(service, "transport"))
+		if d == nil {
+			c.fail(msg)
+			return nil, false
+		}
+		c.okay()
+		return d, true
+	default:
+		c.fail("unknown host service " + service)
+	}
+	return nil, false
+}
+
+// transport resolves the target of host:transport*, or returns the reason
+// the real server would refuse it.
+func (s *Server) transport(target string) (*Device, string) {
+	var d *Device
+	switch {
+	case strings.HasPrefix(target, ":"):
+		serial := strings.TrimPrefix(target, ":")
+		if d = s.findSerial(serial); d == nil {
+			return nil, "device '" + serial + "' not found"
+		}
+	case strings.HasPrefix(target, "-id:"):
+		idStr := strings.TrimPrefix(target, "-id:")
+		id, _ := strconv.ParseInt(idStr, 10, 64)
+		if d = s.findID(id); d == nil {
+			return nil, "no device with transport id '" + idStr + "'"
+		}
+	case target == "-any", target == "-usb", target == "-local":
+		var msg string
+		if d, msg = s.any(); d == nil {
+			return nil, msg
+		}
+	default:
+		return nil, "unknown host service"
+	}
+
+	if msg := d.refusal(); msg != "" {
+		return nil, msg
+	}
+	return d, ""
+}
+
+func (s *Server) any() (*Device, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch len(s.devices) {
+	case 0:
+		return nil, "no devices/emulators found"
+	case 1:
+		return s.devices[0], ""
+	}
+	return nil, "more than one device/emulator"
+}
+
+// track sends the device list now and after every change until the client
+// goes away.
+func (s *Server) track(c *clientConn, long bool) {
+	if c.okay() != nil {
+		return
+	}
+
+	gone := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, c.r)
+		close(gone)
+	}()
+
+	for {
+		s.mu.Lock()
+		changed := s.changed
+		s.mu.Unlock()
+
+		list := s.deviceList(long)
+		_, err := fmt.Fprintf(c, "%04x%s", len(list), list)
+		if err != nil {
+			return
+		}
+
+		select {
+		case <-changed:
+		case <-gone:
+			return
+		}
+	}
+}
+
+func joinFeatures(features []adb.Feature) string {
+	names := make([]string, len(features))
+	for i, f := range features {
+		names[i] = string(f)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,124 @@
+package adbtest_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+// start runs a fake server with one device and returns the client's view of
+// that device.
+func start(t *testing.T) (*adbtest.Server, *adbtest.Device, *adb.Device) {
+	t.Helper()
+
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	fake := s.AddDevice("emulator-5554")
+	d, err := s.Adb().FindDevice("emulator-5554")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, fake, &d
+}
+
+func TestServerVersion(t *testing.T) {
+	s, _, _ := start(t)
+
+	v, err := s.Adb().ServerVersion()
+	if err != nil || v != adbtest.DEFAULT_VERSION {
+		t.Errorf("ServerVersion() = %d, %v, want %d", v, err, adbtest.DEFAULT_VERSION)
+	}
+	if err := s.Adb().RequireServerVersion(adbtest.DEFAULT_VERSION + 1); err == nil {
+		t.Error("RequireServerVersion() of a newer server succeeded")
+	}
+}
+
+func TestListDevices(t *testing.T) {
+	s, fake, _ := start(t)
+	fake.SetProp("ro.build.version.sdk", "30")
+	fake.SetProp("ro.build.version.release", "11")
+
+	other := s.AddDevice("10.0.0.2:5555")
+	other.SetProp("ro.product.manufacturer", "Samsung")
+	s.AddDevice("unauthorized").SetState(adb.StateUnauthorized)
+
+	devices, err := s.Adb().ListDevices(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 2 {
+		t.Fatalf("ListDevices() returned %d devices, want the 2 online ones", len(devices))
+	}
+	if d := devices[0]; d.Serial != "emulator-5554" || d.Sdk != adb.R || d.Version != "11" || d.TransportID == 0 || d.Width != 1080 || d.Height != 2400 {
+		t.Errorf("device 0 = %+v", d)
+	}
+
+	filter, err := adb.ParseDeviceFilter("manufacturer=sam*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err = s.Adb().ListDevices(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 || devices[0].Serial != "10.0.0.2:5555" {
+		t.Errorf("ListDevices(%v) = %v", filter, devices)
+	}
+}
+
+func TestFindDevice(t *testing.T) {
+	s, _, _ := start(t)
+	s.AddDevice("offline").SetState(adb.StateOffline)
+
+	tests := []struct {
+		serial string
+		want   error
+	}{
+		{"emulator-5554", nil},
+		{"offline", adb.ErrDeviceOffline},
+		{"missing", adb.ErrDeviceNotFound},
+	}
+	for _, tt := range tests {
+		_, err := s.Adb().FindDevice(tt.serial)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("FindDevice(%q) error = %v, want %v", tt.serial, err, tt.want)
+		}
+	}
+}
+
+func TestFeatures(t *testing.T) {
+	_, fake, d := start(t)
+	fake.SetFeatures(adb.FeatureCmd)
+
+	features, err := d.Features()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !features.Has(adb.FeatureCmd) || features.Has(adb.FeatureShellV2) {
+		t.Errorf("Features() = %v, want cmd only", features)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	_, fake, d := start(t)
+	pixels := []byte{
+		0xff, 0x00, 0x00, 0xff,
+		0x00, 0xff, 0x00, 0xff,
+	}
+	fake.SetFramebuffer(2, 1, pixels)
+
+	got, err := adb.Frame(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, pixels) {
+		t.Errorf("Frame() = %x, want %x", got, pixels)
+	}
+}
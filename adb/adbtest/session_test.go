@@ -0,0 +1,76 @@
+package adbtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+// upper echoes its input in capitals and reports on stderr.
+func upper(command string, stdin io.Reader) adbtest.ShellResponse {
+	in, _ := io.ReadAll(stdin)
+	return adbtest.ShellResponse{Stdout: strings.ToUpper(string(in)), Stderr: "done\n", ExitCode: 3}
+}
+
+func TestSession(t *testing.T) {
+	_, fake, d := start(t)
+	fake.HandleShell("upper", upper)
+
+	s, err := adb.NewSession(context.Background(), d, nil, "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	io.WriteString(s.Stdin, "hello ")
+	io.WriteString(s.Stdin, "world")
+	err = s.Stdin.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := io.ReadAll(s.Stdout)
+	if err != nil || string(stdout) != "HELLO WORLD" {
+		t.Errorf("stdout = %q, %v", stdout, err)
+	}
+	stderr, err := io.ReadAll(s.Stderr)
+	if err != nil || string(stderr) != "done\n" {
+		t.Errorf("stderr = %q, %v", stderr, err)
+	}
+
+	err = s.Wait()
+	var exitErr *adb.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 3 || s.ExitCode() != 3 {
+		t.Errorf("Wait() = %v, exit code %d, want 3", err, s.ExitCode())
+	}
+}
+
+func TestSessionPty(t *testing.T) {
+	_, fake, d := start(t)
+	fake.HandleShell("upper", upper)
+
+	s, err := adb.NewSession(context.Background(), d, &adb.SessionOptions{Pty: true, Rows: 24, Cols: 80}, "upper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	io.WriteString(s.Stdin, "tty")
+	s.Stdin.Close()
+
+	stdout, _ := io.ReadAll(s.Stdout)
+	stderr, _ := io.ReadAll(s.Stderr)
+	if string(stdout) != "TTYdone\n" || len(stderr) != 0 {
+		t.Errorf("stdout %q stderr %q, want all output on stdout", stdout, stderr)
+	}
+	s.Wait()
+
+	if size := fake.WindowSize(); size != "24x80,0x0" {
+		t.Errorf("window size = %q, want 24x80,0x0", size)
+	}
+}
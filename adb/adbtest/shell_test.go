@@ -0,0 +1,117 @@
+package adbtest_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+func TestShellV2(t *testing.T) {
+	_, fake, d := start(t)
+	fake.RespondShell("ls /nope", adbtest.ShellResponse{
+		Stdout:   "partial\n",
+		Stderr:   "ls: /nope: No such file or directory\n",
+		ExitCode: 2,
+	})
+
+	out, err := adb.Command(d, "echo", "hello", "world").Output()
+	if err != nil || string(out) != "hello world\n" {
+		t.Errorf("echo = %q, %v", out, err)
+	}
+
+	cmd := adb.Command(d, "ls", "/nope")
+	out, err = cmd.Output()
+	var exitErr *adb.ExitError
+	if !errors.As(err, &exitErr) || exitErr.Code != 2 || cmd.ExitCode != 2 {
+		t.Fatalf("ls error = %v, exit code %d, want 2", err, cmd.ExitCode)
+	}
+	if string(out) != "partial\n" || string(exitErr.Stderr) != "ls: /nope: No such file or directory\n" {
+		t.Errorf("ls stdout %q stderr %q, want them apart", out, exitErr.Stderr)
+	}
+}
+
+func TestShellV2Stdin(t *testing.T) {
+	_, fake, d := start(t)
+	fake.HandleShell("wc -c", func(command string, stdin io.Reader) adbtest.ShellResponse {
+		data, _ := io.ReadAll(stdin)
+		return adbtest.ShellResponse{Stdout: fmt.Sprintf("%d\n", len(data))}
+	})
+
+	cmd := adb.Command(d, "wc", "-c")
+	cmd.Stdin = strings.NewReader(strings.Repeat("x", 100000))
+	out, err := cmd.Output()
+	if err != nil || string(out) != "100000\n" {
+		t.Errorf("wc -c = %q, %v, want 100000", out, err)
+	}
+}
+
+func TestLegacyShell(t *testing.T) {
+	_, fake, d := start(t)
+	fake.SetFeatures()
+	fake.RespondShell("false", adbtest.ShellResponse{Stderr: "failed\n", ExitCode: 1})
+
+	out, err := adb.Command(d, "getprop", "ro.serialno").Output()
+	if err != nil || string(out) != "emulator-5554\n" {
+		t.Errorf("getprop = %q, %v", out, err)
+	}
+
+	// The legacy shell merges stderr into stdout but still learns the exit
+	// status.
+	cmd := adb.Command(d, "false")
+	out, err = cmd.Output()
+	var exitErr *adb.ExitError
+	if !errors.As(err, &exitErr) || cmd.ExitCode != 1 {
+		t.Fatalf("false error = %v, exit code %d, want 1", err, cmd.ExitCode)
+	}
+	if string(out) != "failed\n" {
+		t.Errorf("false output = %q, want the merged stderr", out)
+	}
+}
+
+func TestShellWithoutFeatures(t *testing.T) {
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Features = nil
+	s.AddDevice("emulator-5554")
+	d, err := s.Adb().FindDevice("emulator-5554")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A server predating features gets the legacy shell.
+	out, err := adb.Command(&d, "echo", "old").Output()
+	if err != nil || string(out) != "old\n" {
+		t.Errorf("echo = %q, %v", out, err)
+	}
+}
+
+func TestShellOffline(t *testing.T) {
+	_, fake, d := start(t)
+	fake.SetState(adb.StateOffline)
+
+	// The failed feature query is reported rather than falling back to the
+	// legacy shell.
+	_, err := adb.Command(d, "echo", "hi").Output()
+	var serverErr *adb.ServerError
+	if !errors.As(err, &serverErr) || !errors.Is(err, adb.ErrDeviceOffline) || !strings.HasSuffix(serverErr.Request, ":features") {
+		t.Errorf("echo on an offline device error = %v, want the features request to fail", err)
+	}
+}
+
+func TestShellSync(t *testing.T) {
+	_, fake, d := start(t)
+	fake.RespondShell("dumpsys battery*", adbtest.ShellResponse{Stdout: "level: 42\n"})
+
+	out, err := adb.ShellSync(d, "dumpsys", "battery")
+	if err != nil || !strings.Contains(string(out), "level: 42") {
+		t.Errorf("ShellSync() = %q, %v", out, err)
+	}
+}
@@ -0,0 +1,237 @@
+package adbtest
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Mode bits of the sync protocol's stat results.
+const (
+	modeDir     = 0040000
+	modeRegular = 0100000
+)
+
+const syncMaxData = 64 * 1024
+
+type file struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// WriteFile stores a file in the device's filesystem. Directories exist
+// implicitly as the parents of files.
+func (d *Device) WriteFile(name string, data []byte, mode os.FileMode) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.files[path.Clean(name)] = &file{data: append([]byte(nil), data...), mode: mode.Perm(), modTime: time.Now()}
+}
+
+func (d *Device) ReadFile(name string) ([]byte, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.files[path.Clean(name)]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), f.data...), true
+}
+
+// FileMode returns the permission bits a file was stored with.
+func (d *Device) FileMode(name string) (os.FileMode, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f, ok := d.files[path.Clean(name)]
+	if !ok {
+		return 0, false
+	}
+	return f.mode, true
+}
+
+func (d *Device) RemoveFile(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.files, path.Clean(name))
+}
+
+// stat returns the sync mode, size and modification time of name, or a zero
+// mode if it does not exist.
+func (d *Device) stat(name string) (uint32, uint32, uint32) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	name = path.Clean(name)
+	if f, ok := d.files[name]; ok {
+		return modeRegular | uint32(f.mode), uint32(len(f.data)), uint32(f.modTime.Unix())
+	}
+	if d.isDir(name) {
+		return modeDir | 0755, 0, 0
+	}
+	return 0, 0, 0
+}
+
+// isDir reports whether name is the parent of any file. Callers hold d.mu.
+func (d *Device) isDir(name string) bool {
+	if name == "/" {
+		return true
+	}
+	for p := range d.files {
+		if strings.HasPrefix(p, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// sync serves sync requests until the client quits or goes away.
+func (d *Device) sync(c *clientConn) {
+	for {
+		id, arg, err := readSyncRequest(c)
+		if err != nil {
+			return
+		}
+
+		switch id {
+		case "LIST":
+			d.syncList(c, arg)
+		case "STAT":
+			mode, size, mtime := d.stat(arg)
+			io.WriteString(c, "STAT")
+			binary.Write(c, binary.LittleEndian, []uint32{mode, size, mtime})
+		case "RECV":
+			d.syncRecv(c, arg)
+		case "SEND":
+			if d.syncSend(c, arg) != nil {
+				return
+			}
+		default:
+			return
+		}
+	}
+}
+
+func readSyncRequest(r io.Reader) (string, string, error) {
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return "", "", err
+	}
+	arg := make([]byte, binary.LittleEndian.Uint32(header[4:]))
+	_, err = io.ReadFull(r, arg)
+	return string(header[:4]), string(arg), err
+}
+
+func syncFail(w io.Writer, msg string) {
+	io.WriteString(w, "FAIL")
+	binary.Write(w, binary.LittleEndian, uint32(len(msg)))
+	io.WriteString(w, msg)
+}
+
+func (d *Device) syncList(w io.Writer, dir string) {
+	dir = path.Clean(dir)
+
+	d.mu.Lock()
+	if !d.isDir(dir) {
+		d.mu.Unlock()
+		syncFail(w, "opendir failed: No such file or directory")
+		return
+	}
+
+	children := map[string]bool{}
+	for p := range d.files {
+		if rest, ok := strings.CutPrefix(p, strings.TrimSuffix(dir, "/")+"/"); ok {
+			child, _, _ := strings.Cut(rest, "/")
+			children[child] = true
+		}
+	}
+	d.mu.Unlock()
+
+	names := make([]string, 0, len(children))
+	for name := range children {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mode, size, mtime := d.stat(path.Join(dir, name))
+		io.WriteString(w, "DENT")
+		binary.Write(w, binary.LittleEndian, []uint32{mode, size, mtime, uint32(len(name))})
+		io.WriteString(w, name)
+	}
+	io.WriteString(w, "DONE")
+	binary.Write(w, binary.LittleEndian, []uint32{0, 0, 0, 0})
+}
+
+func (d *Device) syncRecv(w io.Writer, name string) {
+	data, ok := d.ReadFile(name)
+	if !ok {
+		syncFail(w, "No such file or directory")
+		return
+	}
+
+	for len(data) > 0 {
+		n := len(data)
+		if n > syncMaxData {
+			n = syncMaxData
+		}
+		io.WriteString(w, "DATA")
+		binary.Write(w, binary.LittleEndian, uint32(n))
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	io.WriteString(w, "DONE")
+	binary.Write(w, binary.LittleEndian, uint32(0))
+}
+
+// syncSend receives a file sent as "path,mode" followed by DATA chunks and a
+// DONE carrying its modification time.
+func (d *Device) syncSend(c *clientConn, arg string) error {
+	name, modeStr, _ := strings.Cut(arg, ",")
+	mode, _ := strconv.ParseUint(modeStr, 10, 32)
+
+	var data []byte
+	for {
+		id, err := readSyncID(c)
+		if err != nil {
+			return err
+		}
+		var n uint32
+		err = binary.Read(c, binary.LittleEndian, &n)
+		if err != nil {
+			return err
+		}
+
+		switch id {
+		case "DATA":
+			chunk := make([]byte, n)
+			_, err = io.ReadFull(c, chunk)
+			if err != nil {
+				return err
+			}
+			data = append(data, chunk...)
+		case "DONE":
+			d.WriteFile(name, data, os.FileMode(mode))
+			d.mu.Lock()
+			d.files[path.Clean(name)].modTime = time.Unix(int64(n), 0)
+			d.mu.Unlock()
+
+			io.WriteString(c, "OKAY")
+			return binary.Write(c, binary.LittleEndian, uint32(0))
+		default:
+			syncFail(c, "invalid data message")
+			return io.ErrUnexpectedEOF
+		}
+	}
+}
+
+func readSyncID(r io.Reader) (string, error) {
+	id := make([]byte, 4)
+	_, err := io.ReadFull(r, id)
+	return string(id), err
+}
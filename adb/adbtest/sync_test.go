@@ -0,0 +1,100 @@
+package adbtest_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+)
+
+func TestPush(t *testing.T) {
+	s, fake, d := start(t)
+	other := s.AddDevice("emulator-5556")
+	d2, err := s.Adb().FindDevice("emulator-5556")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Large enough to need several DATA sections.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 10000)
+	err = adb.Push([]adb.Transporter{d, &d2}, bytes.NewReader(data), 0755, 1700000000, "/data/local/tmp/tool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []interface {
+		ReadFile(string) ([]byte, bool)
+		FileMode(string) (os.FileMode, bool)
+	}{fake, other} {
+		got, ok := f.ReadFile("/data/local/tmp/tool")
+		if !ok || !bytes.Equal(got, data) {
+			t.Errorf("pushed %d bytes, device has %d", len(data), len(got))
+		}
+		if mode, _ := f.FileMode("/data/local/tmp/tool"); mode != 0755 {
+			t.Errorf("pushed mode 0755, device has %#o", mode)
+		}
+	}
+}
+
+func TestPull(t *testing.T) {
+	_, fake, d := start(t)
+	data := bytes.Repeat([]byte("pull"), 50000)
+	fake.WriteFile("/sdcard/big.bin", data, 0644)
+
+	var buf bytes.Buffer
+	err := adb.Pull(d, &buf, "/sdcard/big.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Errorf("pulled %d bytes, want %d", buf.Len(), len(data))
+	}
+
+	err = adb.Pull(d, &buf, "/sdcard/missing")
+	var serverErr *adb.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("Pull() of a missing file error = %v, want a *ServerError", err)
+	}
+}
+
+type failingWriter struct{}
+
+var errWrite = errors.New("write failed")
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errWrite
+}
+
+func TestPullWriteError(t *testing.T) {
+	_, fake, d := start(t)
+	fake.WriteFile("/sdcard/big.bin", bytes.Repeat([]byte("pull"), 75000), 0644)
+
+	err := adb.Pull(d, failingWriter{}, "/sdcard/big.bin")
+	if !errors.Is(err, errWrite) {
+		t.Errorf("Pull() error = %v, want %v", err, errWrite)
+	}
+}
+
+func TestLs(t *testing.T) {
+	_, fake, d := start(t)
+	fake.WriteFile("/sdcard/a.txt", nil, 0644)
+	fake.WriteFile("/sdcard/Download/b.txt", nil, 0644)
+
+	names, err := adb.Ls(d, "/sdcard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(names) != "Download\na.txt\n" {
+		t.Errorf("Ls() = %q", names)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = adb.LsContext(ctx, d, "/sdcard")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("LsContext() with a cancelled context error = %v", err)
+	}
+}
@@ -0,0 +1,84 @@
+package adbtest_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+// roundTrip sends msg over conn and reads back the echo.
+func roundTrip(t *testing.T, conn net.Conn, msg string) {
+	t.Helper()
+	_, err := io.WriteString(conn, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	if err != nil || string(got) != msg {
+		t.Fatalf("echo = %q, %v, want %q", got, err, msg)
+	}
+}
+
+func TestDialService(t *testing.T) {
+	_, _, d := start(t)
+
+	conn, err := d.DialService(context.Background(), adbtest.EchoService)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn, "ping")
+	roundTrip(t, conn, "pong")
+
+	_, err = d.DialService(context.Background(), "tcp:8")
+	var serverErr *adb.ServerError
+	if !errors.As(err, &serverErr) {
+		t.Errorf("DialService() of a closed port error = %v, want a *ServerError", err)
+	}
+}
+
+func TestServeForward(t *testing.T) {
+	_, _, d := start(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- adb.ServeForward(ctx, l, d, adbtest.EchoService)
+	}()
+
+	local, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer local.Close()
+	roundTrip(t, local, "through the tunnel")
+
+	// Cancelling stops the listener and closes forwarded connections.
+	cancel()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("ServeForward() = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeForward() did not return")
+	}
+
+	local.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = local.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Errorf("read from a forwarded connection after cancel = %v, want EOF", err)
+	}
+}
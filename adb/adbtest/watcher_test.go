@@ -0,0 +1,88 @@
+package adbtest_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+func nextEvent(t *testing.T, w *adb.DeviceWatcher) adb.DeviceEvent {
+	t.Helper()
+	select {
+	case e, ok := <-w.Events:
+		if !ok {
+			t.Fatal("watcher closed")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatal("no event")
+	}
+	panic("unreachable")
+}
+
+func TestWatchDevices(t *testing.T) {
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.AddDevice("emulator-5554")
+
+	w := s.Adb().WatchDevices(context.Background())
+	defer w.Close()
+
+	e := nextEvent(t, w)
+	if e.Type != adb.Connected || e.Device.Serial != "emulator-5554" {
+		t.Fatalf("first event = %v %v", e.Type, e.Info)
+	}
+	first := e.Device
+
+	fake := s.AddDevice("emulator-5556")
+	e = nextEvent(t, w)
+	if e.Type != adb.Connected || e.Device.Serial != "emulator-5556" || e.Device.TransportID != fake.TransportID {
+		t.Fatalf("event = %v %v, want emulator-5556 connected", e.Type, e.Info)
+	}
+
+	fake.SetState(adb.StateOffline)
+	e = nextEvent(t, w)
+	if e.Type != adb.StateChanged || e.OldState != adb.StateDevice || e.Info.State != adb.StateOffline {
+		t.Fatalf("event = %v %v, want a change to offline", e.Type, e.Info)
+	}
+
+	s.RemoveDevice("emulator-5554")
+	e = nextEvent(t, w)
+	if e.Type != adb.Disconnected || e.Device != first {
+		t.Fatalf("event = %v %v, want emulator-5554 disconnected", e.Type, e.Info)
+	}
+}
+
+func TestWatchDevicesSharedSerial(t *testing.T) {
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	w := s.Adb().WatchDevices(context.Background())
+	defer w.Close()
+
+	// Cheap devices often share a serial; their transport ids tell them
+	// apart.
+	a := s.AddDevice("0123456789ABCDEF")
+	b := s.AddDevice("0123456789ABCDEF")
+
+	seen := map[int64]bool{}
+	for len(seen) < 2 {
+		e := nextEvent(t, w)
+		if e.Type != adb.Connected {
+			t.Fatalf("event = %v %v, want connected", e.Type, e.Info)
+		}
+		seen[e.Device.TransportID] = true
+	}
+	if !seen[a.TransportID] || !seen[b.TransportID] {
+		t.Errorf("connected transport ids %v, want %d and %d", seen, a.TransportID, b.TransportID)
+	}
+}
@@ -2,12 +2,14 @@ package adb
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strconv"
 	"strings"
+	"time"
 )
 
 type Transport int
@@ -23,27 +25,107 @@ type Transporter interface {
 	Transport(conn *AdbConn) error
 }
 
+// ContextTransporter is a Transporter that can bind its connections to a
+// context. The connection is closed as soon as the context is done.
+type ContextTransporter interface {
+	Transporter
+	DialContext(ctx context.Context) (*AdbConn, error)
+}
+
 type Dialer struct {
 	Host string
 	Port int
+
+	// NetDial opens the connection to the server. It defaults to
+	// net.Dialer.DialContext and can be replaced to record or replay
+	// traffic; see Recorder and Replayer.
+	NetDial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 type AdbConn struct {
 	conn net.Conn
 	r    *bufio.Reader
+	stop func() bool
 }
 
 func (a *Dialer) Dial() (*AdbConn, error) {
-	h := fmt.Sprintf("%s:%d", a.Host, a.Port)
-	c, err := net.Dial("tcp", h)
+	return a.DialContext(context.Background())
+}
+
+// DialContext connects to the adb server. The returned connection is closed
+// when ctx is done, unblocking any pending reads or writes.
+func (a *Dialer) DialContext(ctx context.Context) (*AdbConn, error) {
+	dial := a.NetDial
+	if dial == nil {
+		var d net.Dialer
+		dial = d.DialContext
+	}
+	h := net.JoinHostPort(a.Host, strconv.Itoa(a.Port))
+	c, err := dial(ctx, "tcp", h)
 	if err != nil {
-		if c != nil {
-			fmt.Printf("Closing connection to %s\n", c)
-			c.Close()
-		}
 		return nil, err
 	}
-	return &AdbConn{c, bufio.NewReader(c)}, nil
+	conn := &AdbConn{conn: c, r: bufio.NewReader(c)}
+	conn.bind(ctx)
+	return conn, nil
+}
+
+// dial opens a connection for t bound to ctx. Transporters that do not
+// implement ContextTransporter are dialed normally and closed on cancel.
+func dial(ctx context.Context, t Transporter) (*AdbConn, error) {
+	if ct, ok := t.(ContextTransporter); ok {
+		return ct.DialContext(ctx)
+	}
+	conn, err := t.Dial()
+	if err != nil {
+		return nil, err
+	}
+	conn.bind(ctx)
+	return conn, nil
+}
+
+// dialTransport dials t and switches the connection to its transport.
+func dialTransport(ctx context.Context, t Transporter) (*AdbConn, error) {
+	conn, err := dial(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+	err = t.Transport(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// query sends a host request and returns the length-prefixed reply.
+func (a *Dialer) query(ctx context.Context, req string) (string, error) {
+	conn, err := a.DialContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteCmd(req)
+	if err != nil {
+		return "", err
+	}
+	return conn.readString()
+}
+
+func (a *AdbConn) bind(ctx context.Context) {
+	a.unbind()
+	a.stop = context.AfterFunc(ctx, func() {
+		a.Close()
+	})
+}
+
+// unbind detaches the connection from the context it was dialed with.
+func (a *AdbConn) unbind() {
+	if a.stop != nil {
+		a.stop()
+		a.stop = nil
+	}
 }
 
 func (a *AdbConn) TransportAny() error {
@@ -70,6 +152,12 @@ func (a *AdbConn) TransportSerial(ser string) error {
 	return err
 }
 
+func (a *AdbConn) TransportID(id int64) error {
+	cmd := fmt.Sprintf("host:transport-id:%d", id)
+	_, err := a.WriteCmd(cmd)
+	return err
+}
+
 func (a *AdbConn) Shell(args ...string) error {
 	cmd := fmt.Sprintf("shell:%s", strings.Join(args, " "))
 	_, err := a.WriteCmd(cmd)
@@ -84,10 +172,24 @@ func (a *AdbConn) Log(args ...string) error {
 
 func (a *AdbConn) readSize(bcount int) (uint64, error) {
 	size := make([]byte, bcount)
-	a.r.Read(size)
+	_, err := io.ReadFull(a, size)
+	if err != nil {
+		return 0, err
+	}
 	return strconv.ParseUint(string(size), 16, 0)
 }
 
+// readString reads a hex length-prefixed string as sent by the adb server.
+func (a *AdbConn) readString() (string, error) {
+	size, err := a.readSize(4)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(a, b)
+	return string(b), err
+}
+
 func (a *AdbConn) WriteCmd(cmd string) (int, error) {
 	prefix := fmt.Sprintf("%04x", len(cmd))
 	w := bufio.NewWriter(a)
@@ -100,30 +202,42 @@ func (a *AdbConn) WriteCmd(cmd string) (int, error) {
 
 	w.Flush()
 
-	return i, a.VerifyOk()
-}
-
-func (a *AdbConn) readUint32() uint32 {
-	size := make([]byte, 4)
-	a.r.Read(size)
-	return binary.LittleEndian.Uint32(size)
+	err = a.VerifyOk()
+	var serr *ServerError
+	if errors.As(err, &serr) {
+		serr.Request = cmd
+	}
+	return i, err
 }
 
 func (a *AdbConn) ReadCode() (string, error) {
 	status := make([]byte, 4)
-	_, err := a.Read(status)
+	_, err := io.ReadFull(a, status)
 	if err != nil {
 		return "UNKN", err
 	}
 	return string(status), nil
 }
 
+// VerifyOk reads the status of the last request. A FAIL status is returned
+// as a *ServerError carrying the reason sent by the server.
 func (a *AdbConn) VerifyOk() error {
 	code, err := a.ReadCode()
-	if err != nil || code != `OKAY` {
-		return errors.New(`Invalid connection CODE: ` + code)
+	if err != nil {
+		return err
 	}
-	return nil
+
+	switch code {
+	case `OKAY`:
+		return nil
+	case `FAIL`:
+		msg, err := a.readString()
+		if err != nil {
+			return err
+		}
+		return &ServerError{Message: msg}
+	}
+	return errors.New(`Invalid connection CODE: ` + code)
 }
 
 func (a *AdbConn) Write(b []byte) (int, error) {
@@ -144,8 +258,35 @@ func (a *AdbConn) Read(p []byte) (int, error) {
 }
 
 func (a *AdbConn) Close() error {
+	if a.stop != nil {
+		a.stop()
+	}
 	if a.conn != nil {
 		return a.conn.Close()
 	}
 	return nil
 }
+
+// AdbConn implements net.Conn so that streams opened with DialService can be
+// handed to code expecting a plain network connection.
+var _ net.Conn = (*AdbConn)(nil)
+
+func (a *AdbConn) LocalAddr() net.Addr {
+	return a.conn.LocalAddr()
+}
+
+func (a *AdbConn) RemoteAddr() net.Addr {
+	return a.conn.RemoteAddr()
+}
+
+func (a *AdbConn) SetDeadline(t time.Time) error {
+	return a.conn.SetDeadline(t)
+}
+
+func (a *AdbConn) SetReadDeadline(t time.Time) error {
+	return a.conn.SetReadDeadline(t)
+}
+
+func (a *AdbConn) SetWriteDeadline(t time.Time) error {
+	return a.conn.SetWriteDeadline(t)
+}
@@ -2,11 +2,11 @@ package adb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"math"
 	"regexp"
 	"strconv"
-	"strings"
 	"sync"
 )
 
@@ -15,9 +15,13 @@ type DeviceType int
 type SdkVersion int
 
 const (
-	PHONE DeviceType = iota
+	// ANY_TYPE and TABLET only appear in filters; TABLET matches both
+	// tablet sizes.
+	ANY_TYPE DeviceType = iota
+	PHONE
 	TABLET_7
 	TABLET_10
+	TABLET
 )
 
 const (
@@ -45,13 +49,30 @@ const (
 	KITKAT
 	WEAR
 	LOLLIPOP
-	LATEST = LOLLIPOP
+	LOLLIPOP_MR1
+	MARSHMALLOW
+	NOUGAT
+	NOUGAT_MR1
+	OREO
+	OREO_MR1
+	PIE
+	Q
+	R
+	S
+	S_V2
+	TIRAMISU
+	UPSIDE_DOWN_CAKE
+	VANILLA_ICE_CREAM
+	BAKLAVA
+	LATEST = BAKLAVA
 )
 
 var typeMap = map[DeviceType]string{
+	ANY_TYPE:  `Any`,
 	PHONE:     `Phone`,
 	TABLET_7:  `7in Tablet`,
 	TABLET_10: `10in Tablet`,
+	TABLET:    `Tablet`,
 }
 
 var sdkMap = map[SdkVersion]string{
@@ -70,11 +91,27 @@ var sdkMap = map[SdkVersion]string{
 	KITKAT:                 `KITKAT`,
 	WEAR:                   `WEAR v1`,
 	LOLLIPOP:               `LOLLIPOP`,
+	LOLLIPOP_MR1:           `LOLLIPOP_MR1`,
+	MARSHMALLOW:            `MARSHMALLOW`,
+	NOUGAT:                 `NOUGAT`,
+	NOUGAT_MR1:             `NOUGAT_MR1`,
+	OREO:                   `OREO`,
+	OREO_MR1:               `OREO_MR1`,
+	PIE:                    `PIE`,
+	Q:                      `Q`,
+	R:                      `R`,
+	S:                      `S`,
+	S_V2:                   `S_V2`,
+	TIRAMISU:               `TIRAMISU`,
+	UPSIDE_DOWN_CAKE:       `UPSIDE_DOWN_CAKE`,
+	VANILLA_ICE_CREAM:      `VANILLA_ICE_CREAM`,
+	BAKLAVA:                `BAKLAVA`,
 }
 
 type Device struct {
 	Dialer       `json:"-"`
 	Serial       string            `json:"serial"`
+	TransportID  int64             `json:"transport_id,omitempty"`
 	Manufacturer string            `json:"manufacturer"`
 	Model        string            `json:"model"`
 	Sdk          SdkVersion        `json:"sdk"`
@@ -83,6 +120,8 @@ type Device struct {
 	Height       int64             `json:"height"`
 	Width        int64             `json:"width"`
 	Properties   map[string]string `json:_`
+
+	features FeatureSet
 }
 
 type DeviceFilter struct {
@@ -91,27 +130,38 @@ type DeviceFilter struct {
 	Density DensityBucket
 	MinSdk  SdkVersion
 	MaxSdk  SdkVersion
+
+	// Versions constrain ro.build.version.release, compared numerically.
+	Versions []VersionConstraint
+	// Manufacturer and Model are case-insensitive glob patterns.
+	Manufacturer string
+	Model        string
+	// Properties maps property names to glob patterns of their values.
+	Properties map[string]string
+	// Count limits how many matching devices are listed. Zero means all.
+	Count int
 }
 
 var (
 	AllDevices = &DeviceFilter{MaxSdk: LATEST}
+
+	propRegex = regexp.MustCompile(`\[(.*)\]: \[(.*)\]`)
+	sizeRegex = regexp.MustCompile(`(Physical|Override) size: (\d+)x(\d+)`)
 )
 
 func (s SdkVersion) String() string {
 	return sdkMap[s]
 }
 
-// filter -f "serials=[...];type=tablet;count=5;version >= 4.1.1;"
-
-/*func GetFilter(arg string) {*/
-
-/*}*/
-
-type DeviceWatcher []chan []*Device
-
+// Type classifies the device by its smallest width in dp, as Android picks
+// sw600dp and sw720dp resources. A device of unknown size or density is a
+// phone.
 func (d *Device) Type() DeviceType {
+	if d.Density <= 0 {
+		return PHONE
+	}
 	sw := math.Min(float64(d.Height), float64(d.Width))
-	dip := float64(LDPI) / float64(d.Density) * sw
+	dip := float64(MDPI) / float64(d.Density) * sw
 	if dip >= 720 {
 		return TABLET_10
 	} else if dip >= 600 {
@@ -120,41 +170,69 @@ func (d *Device) Type() DeviceType {
 	return PHONE
 }
 
+// Transport selects the device by transport id when it is known, so that
+// devices sharing a serial can be told apart, and by serial otherwise.
 func (d *Device) Transport(conn *AdbConn) error {
+	if d.TransportID != 0 {
+		return conn.TransportID(d.TransportID)
+	}
 	return conn.TransportSerial(d.Serial)
 }
 
-func (adb *Adb) ParseDevices(filter *DeviceFilter, input []byte) []*Device {
-	lines := strings.Split(string(input), "\n")
-
-	devices := make([]*Device, 0, len(lines))
+func (d *Device) HostPrefix() string {
+	if d.TransportID != 0 {
+		return fmt.Sprintf("host-transport-id:%d", d.TransportID)
+	}
+	return "host-serial:" + d.Serial
+}
 
-	var wg sync.WaitGroup
+func (adb *Adb) ParseDevices(filter *DeviceFilter, input []byte) ([]*Device, error) {
+	return adb.parseDevices(context.Background(), filter, input)
+}
 
-	for _, line := range lines {
-		if strings.Contains(line, "device") && strings.TrimSpace(line) != "" {
-			device := strings.Split(line, "\t")[0]
+func (adb *Adb) parseDevices(ctx context.Context, filter *DeviceFilter, input []byte) ([]*Device, error) {
+	return adb.updateDevices(ctx, filter, parseDeviceList(string(input)))
+}
 
-			d := &Device{Dialer: adb.Dialer, Serial: device}
-			devices = append(devices, d)
+// updateDevices loads the properties of every online device in infos and
+// returns those matching filter. A device that fails to load, for example
+// because it was just unplugged, is left out rather than failing the list.
+func (adb *Adb) updateDevices(ctx context.Context, filter *DeviceFilter, infos []DeviceInfo) ([]*Device, error) {
+	devices := make([]*Device, 0, len(infos))
+	failed := make([]bool, len(infos))
 
-			wg.Add(1)
-			go func() {
-				defer wg.Done()
-				d.Update()
-			}()
+	var wg sync.WaitGroup
+	for _, info := range infos {
+		if info.State != StateDevice {
+			continue
 		}
+
+		i := len(devices)
+		d := &Device{Dialer: adb.Dialer, Serial: info.Serial, TransportID: info.TransportID}
+		devices = append(devices, d)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			failed[i] = d.load(ctx) != nil
+		}()
 	}
 
 	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
 
-	result := make([]*Device, 0, len(lines))
-	for _, device := range devices {
-		if device.MatchFilter(filter) {
+	result := make([]*Device, 0, len(devices))
+	for i, device := range devices {
+		if filter != nil && filter.Count > 0 && len(result) == filter.Count {
+			break
+		}
+		if !failed[i] && device.MatchFilter(filter) {
 			result = append(result, device)
 		}
 	}
-	return result
+	return result, nil
 }
 
 func stringInSlice(a string, list []string) bool {
@@ -179,47 +257,77 @@ func (d *Device) MatchFilter(filter *DeviceFilter) bool {
 		return false
 	} else if filter.Density != 0 && filter.Density != d.Density {
 		return false
+	} else if !d.matchType(filter.Type) {
+		return false
+	} else if !matchGlob(filter.Manufacturer, d.Manufacturer) || !matchGlob(filter.Model, d.Model) {
+		return false
+	}
+
+	for _, c := range filter.Versions {
+		if !c.Match(d.Version) {
+			return false
+		}
+	}
+	for prop, pattern := range filter.Properties {
+		if !matchGlob(pattern, d.GetProp(prop)) {
+			return false
+		}
 	}
 	return true
 }
 
-func (d *Device) RefreshProps() {
-	d.Properties = make(map[string]string)
+func (d *Device) matchType(t DeviceType) bool {
+	switch t {
+	case ANY_TYPE:
+		return true
+	case TABLET:
+		return d.Type() != PHONE
+	}
+	return d.Type() == t
+}
 
-	proprx, err := regexp.Compile("\\[(.*)\\]: \\[(.*)\\]")
+func (d *Device) RefreshProps() error {
+	return d.RefreshPropsContext(context.Background())
+}
 
+func (d *Device) RefreshPropsContext(ctx context.Context) error {
+	out, err := ShellContext(ctx, d, "getprop")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	out := Shell(d, "getprop")
+	d.Properties = make(map[string]string)
 	for line := range out {
 		if line != nil {
-			matches := proprx.FindSubmatch(line)
+			matches := propRegex.FindSubmatch(line)
 			if len(matches) > 2 {
 				d.Properties[string(matches[1])] = string(matches[2])
 			}
 		}
 	}
+	return ctx.Err()
 }
 
 func (d *Device) GetProp(prop string) string {
 	return d.Properties[prop]
 }
 
-func (d *Device) HasPackage(pack string) bool {
-	return d.findValue(pack, "pm", "list", "packages", "-3")
-}
-
-func (d *Device) SetScreenOn(on bool) {
-	current := d.findValue("mScreenOn=false", "dumpsys", "input_method")
+func (d *Device) SetScreenOn(on bool) error {
+	current, err := d.findValue("mScreenOn=false", "dumpsys", "input_method")
+	if err != nil {
+		return err
+	}
 	if current && on || !current && !on {
-		d.SendKey(26)
+		return d.SendKey(26)
 	}
+	return nil
 }
 
-func (d *Device) findValue(val string, args ...string) bool {
-	out := Shell(d, args...)
+func (d *Device) findValue(val string, args ...string) (bool, error) {
+	out, err := Shell(d, args...)
+	if err != nil {
+		return false, err
+	}
 	current := false
 	for line := range out {
 		if line != nil {
@@ -229,24 +337,50 @@ func (d *Device) findValue(val string, args ...string) bool {
 			}
 		}
 	}
-	return current
+	// Drain the rest so the shell goroutine can exit.
+	for range out {
+	}
+	return current, nil
 }
 
-func (d *Device) SendKey(aKey int) {
-	ShellSync(d, "input", "keyevent", fmt.Sprintf("%d", aKey))
+func (d *Device) SendKey(aKey int) error {
+	_, err := ShellSync(d, "input", "keyevent", fmt.Sprintf("%d", aKey))
+	return err
 }
 
-func (d *Device) Unlock() {
-	current := d.findValue("mLockScreenShown true", "dumpsys", "activity")
+func (d *Device) Unlock() error {
+	current, err := d.findValue("mLockScreenShown true", "dumpsys", "activity")
+	if err != nil {
+		return err
+	}
 	if current {
-		d.SendKey(82)
+		return d.SendKey(82)
 	}
+	return nil
 }
 
-func (d *Device) Update() {
+func (d *Device) Update() error {
+	return d.UpdateContext(context.Background())
+}
 
-	WaitFor(d)
-	d.RefreshProps()
+// UpdateContext waits for the device to come online and reloads its
+// properties, giving up when ctx is done.
+func (d *Device) UpdateContext(ctx context.Context) error {
+	err := WaitForContext(ctx, d)
+	if err != nil {
+		return err
+	}
+	return d.load(ctx)
+}
+
+// load reloads the properties of a device already known to be online.
+// Unlike UpdateContext it fails straight away if the device has gone.
+func (d *Device) load(ctx context.Context) error {
+	d.features = nil
+	err := d.RefreshPropsContext(ctx)
+	if err != nil {
+		return err
+	}
 
 	out := []string{
 		d.GetProp("ro.product.manufacturer"),
@@ -267,6 +401,28 @@ func (d *Device) Update() {
 	// Parse DensityBucket
 	density, _ := strconv.ParseInt(out[4], 10, 0)
 	d.Density = DensityBucket(density)
+
+	// Parse the screen size. Devices older than 4.3 have no wm and are left
+	// at zero.
+	size, err := ShellSyncContext(ctx, d, "wm", "size")
+	if err != nil {
+		return err
+	}
+	d.Width, d.Height = parseScreenSize(string(size))
+	return nil
+}
+
+// parseScreenSize returns the screen size in pixels from the output of
+// "wm size", preferring the override size to the physical one.
+func parseScreenSize(out string) (width, height int64) {
+	for _, match := range sizeRegex.FindAllStringSubmatch(out, -1) {
+		w, _ := strconv.ParseInt(match[2], 10, 64)
+		h, _ := strconv.ParseInt(match[3], 10, 64)
+		if match[1] == "Override" || width == 0 {
+			width, height = w, h
+		}
+	}
+	return width, height
 }
 
 func (d *Device) String() string {
@@ -0,0 +1,89 @@
+package adb
+
+import (
+	"context"
+	"strconv"
+	"strings"
+)
+
+type DeviceState string
+
+const (
+	StateDevice        DeviceState = "device"
+	StateOffline       DeviceState = "offline"
+	StateUnauthorized  DeviceState = "unauthorized"
+	StateAuthorizing   DeviceState = "authorizing"
+	StateConnecting    DeviceState = "connecting"
+	StateRecovery      DeviceState = "recovery"
+	StateRescue        DeviceState = "rescue"
+	StateSideload      DeviceState = "sideload"
+	StateBootloader    DeviceState = "bootloader"
+	StateHost          DeviceState = "host"
+	StateNoPermissions DeviceState = "no permissions"
+)
+
+// DeviceInfo is one entry of the server's device list as reported by
+// host:devices-l.
+type DeviceInfo struct {
+	Serial      string      `json:"serial"`
+	State       DeviceState `json:"state"`
+	UsbPath     string      `json:"usb,omitempty"`
+	Product     string      `json:"product,omitempty"`
+	Model       string      `json:"model,omitempty"`
+	DeviceName  string      `json:"device,omitempty"`
+	TransportID int64       `json:"transport_id,omitempty"`
+}
+
+// DeviceList returns every device known to the server, whatever its state.
+func (adb *Adb) DeviceList() ([]DeviceInfo, error) {
+	return adb.DeviceListContext(context.Background())
+}
+
+func (adb *Adb) DeviceListContext(ctx context.Context) ([]DeviceInfo, error) {
+	list, err := adb.query(ctx, "host:devices-l")
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceList(list), nil
+}
+
+// parseDeviceList parses the output of host:devices or host:devices-l.
+func parseDeviceList(list string) []DeviceInfo {
+	lines := strings.Split(list, "\n")
+	infos := make([]DeviceInfo, 0, len(lines))
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+
+		info := DeviceInfo{Serial: fields[0], State: DeviceState(fields[1])}
+		rest := fields[2:]
+		if fields[1] == "no" && len(fields) > 2 && fields[2] == "permissions" {
+			// The state is followed by a free-form hint before the details.
+			info.State = StateNoPermissions
+			rest = fields[3:]
+		}
+
+		for _, field := range rest {
+			key, value, ok := strings.Cut(field, ":")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "usb":
+				info.UsbPath = value
+			case "product":
+				info.Product = value
+			case "model":
+				info.Model = value
+			case "device":
+				info.DeviceName = value
+			case "transport_id":
+				info.TransportID, _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
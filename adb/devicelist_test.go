@@ -0,0 +1,60 @@
+package adb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceList(t *testing.T) {
+	tests := []struct {
+		name string
+		list string
+		want []DeviceInfo
+	}{
+		{
+			name: "empty",
+			list: "",
+			want: []DeviceInfo{},
+		},
+		{
+			name: "short",
+			list: "emulator-5554\tdevice\n0123456789ABCDEF\tunauthorized\n",
+			want: []DeviceInfo{
+				{Serial: "emulator-5554", State: StateDevice},
+				{Serial: "0123456789ABCDEF", State: StateUnauthorized},
+			},
+		},
+		{
+			name: "long",
+			list: "emulator-5554          device product:sdk_gphone64 model:sdk_gphone64 device:emu64a transport_id:1\n" +
+				"0123456789ABCDEF       device usb:1-1 product:oriole model:Pixel_6 device:oriole transport_id:7\n",
+			want: []DeviceInfo{
+				{Serial: "emulator-5554", State: StateDevice, Product: "sdk_gphone64", Model: "sdk_gphone64", DeviceName: "emu64a", TransportID: 1},
+				{Serial: "0123456789ABCDEF", State: StateDevice, UsbPath: "1-1", Product: "oriole", Model: "Pixel_6", DeviceName: "oriole", TransportID: 7},
+			},
+		},
+		{
+			name: "network serial",
+			list: "10.0.0.2:5555          offline transport_id:3\n",
+			want: []DeviceInfo{
+				{Serial: "10.0.0.2:5555", State: StateOffline, TransportID: 3},
+			},
+		},
+		{
+			name: "no permissions",
+			list: "0123456789ABCDEF       no permissions (user in plugdev group; are your udev rules wrong?); see [http://developer.android.com/tools/device.html] usb:1-1 transport_id:2\n",
+			want: []DeviceInfo{
+				{Serial: "0123456789ABCDEF", State: StateNoPermissions, UsbPath: "1-1", TransportID: 2},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDeviceList(tt.list)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDeviceList() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,46 @@
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	ErrDeviceNotFound    = errors.New("device not found")
+	ErrMoreThanOneDevice = errors.New("more than one device or emulator")
+	ErrDeviceOffline     = errors.New("device offline")
+	ErrUnauthorized      = errors.New("device unauthorized")
+)
+
+// ServerError is returned when the adb server answers a request with FAIL.
+// It matches the Err* values above with errors.Is when the server message
+// describes one of them.
+type ServerError struct {
+	// Request is the service that was refused, e.g. "host:transport:xyz".
+	Request string
+	// Message is the reason sent by the server, e.g. "device unauthorized".
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	if e.Request == "" {
+		return "adb: " + e.Message
+	}
+	return fmt.Sprintf("adb: %s: %s", e.Request, e.Message)
+}
+
+func (e *ServerError) Is(target error) bool {
+	msg := strings.ToLower(e.Message)
+	switch target {
+	case ErrDeviceNotFound:
+		return strings.Contains(msg, "not found") || strings.Contains(msg, "no devices")
+	case ErrMoreThanOneDevice:
+		return strings.Contains(msg, "more than one")
+	case ErrDeviceOffline:
+		return strings.Contains(msg, "offline")
+	case ErrUnauthorized:
+		return strings.Contains(msg, "unauthorized")
+	}
+	return false
+}
@@ -0,0 +1,106 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"strings"
+)
+
+type Feature string
+
+const (
+	FeatureShellV2                   Feature = "shell_v2"
+	FeatureCmd                       Feature = "cmd"
+	FeatureStatV2                    Feature = "stat_v2"
+	FeatureLsV2                      Feature = "ls_v2"
+	FeatureApex                      Feature = "apex"
+	FeatureAbb                       Feature = "abb"
+	FeatureAbbExec                   Feature = "abb_exec"
+	FeatureSendRecvV2                Feature = "sendrecv_v2"
+	FeatureFixedPushMkdir            Feature = "fixed_push_mkdir"
+	FeatureFixedPushSymlinkTimestamp Feature = "fixed_push_symlink_timestamp"
+	FeatureRemountShell              Feature = "remount_shell"
+	FeatureTrackApp                  Feature = "track_app"
+)
+
+// FeatureSet is the set of features advertised by the adb server or a device.
+type FeatureSet map[Feature]bool
+
+func (f FeatureSet) Has(feature Feature) bool {
+	return f[feature]
+}
+
+func (f FeatureSet) String() string {
+	names := make([]string, 0, len(f))
+	for feature := range f {
+		names = append(names, string(feature))
+	}
+	return strings.Join(names, ",")
+}
+
+func parseFeatures(list string) FeatureSet {
+	features := make(FeatureSet)
+	for _, name := range strings.Split(strings.TrimSpace(list), ",") {
+		if name != "" {
+			features[Feature(name)] = true
+		}
+	}
+	return features
+}
+
+// HostFeatures returns the features supported by the adb server itself.
+func (adb *Adb) HostFeatures() (FeatureSet, error) {
+	return adb.HostFeaturesContext(context.Background())
+}
+
+func (adb *Adb) HostFeaturesContext(ctx context.Context) (FeatureSet, error) {
+	list, err := adb.query(ctx, "host:features")
+	if err != nil {
+		return nil, err
+	}
+	return parseFeatures(list), nil
+}
+
+// Features returns the features shared by the device and the adb server.
+// The set is fetched once and cached on the device; Update clears it.
+func (d *Device) Features() (FeatureSet, error) {
+	return d.FeaturesContext(context.Background())
+}
+
+func (d *Device) FeaturesContext(ctx context.Context) (FeatureSet, error) {
+	if d.features != nil {
+		return d.features, nil
+	}
+
+	list, err := d.query(ctx, hostRequest(d, "features"))
+	if err != nil {
+		return nil, err
+	}
+	d.features = parseFeatures(list)
+	return d.features, nil
+}
+
+// featureSource is implemented by transporters that can report the features
+// of the device they reach, such as *Device.
+type featureSource interface {
+	FeaturesContext(ctx context.Context) (FeatureSet, error)
+}
+
+// hasFeature reports whether t supports feature. Transporters that cannot
+// report features are assumed to support it, and a server that predates
+// feature negotiation is assumed to support none. Any other failure of the
+// query is returned.
+func hasFeature(ctx context.Context, t Transporter, feature Feature) (bool, error) {
+	fs, ok := t.(featureSource)
+	if !ok {
+		return true, nil
+	}
+	features, err := fs.FeaturesContext(ctx)
+	var serr *ServerError
+	if errors.As(err, &serr) && strings.Contains(serr.Message, "unknown host service") {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return features.Has(feature), nil
+}
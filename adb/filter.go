@@ -0,0 +1,244 @@
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidFilter = errors.New("adb: invalid device filter")
+
+// filterOps are tried longest first so ">=" is not read as ">".
+var filterOps = []string{">=", "<=", "!=", "=", ">", "<"}
+
+var densityNames = map[string]DensityBucket{
+	"ldpi":    LDPI,
+	"mdpi":    MDPI,
+	"hdpi":    HDPI,
+	"xhdpi":   XHDPI,
+	"xxhdpi":  XXHDPI,
+	"xxxhdpi": XXXHDPI,
+}
+
+var typeNames = map[string]DeviceType{
+	"any":      ANY_TYPE,
+	"phone":    PHONE,
+	"tablet":   TABLET,
+	"tablet7":  TABLET_7,
+	"tablet10": TABLET_10,
+}
+
+// VersionConstraint compares a dotted version such as "4.1.1" with Op,
+// one of =, !=, <, <=, > and >=.
+type VersionConstraint struct {
+	Op      string
+	Version string
+}
+
+func (c VersionConstraint) Match(version string) bool {
+	cmp := compareVersions(version, c.Version)
+	switch c.Op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// compareVersions compares dotted versions component by component, treating
+// missing components as zero.
+func compareVersions(a, b string) int {
+	as := strings.Split(a, ".")
+	bs := strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// matchGlob reports whether value matches the case-insensitive glob pattern.
+// An empty pattern matches everything.
+func matchGlob(pattern, value string) bool {
+	if pattern == "" {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(value))
+	return ok
+}
+
+// ParseDeviceFilter parses a filter made of clauses separated by semicolons,
+// e.g. "serials=[a,b];type=tablet;count=5;version >= 4.1.1;". The keys are
+//
+//	serial, serials   a serial or a bracketed list of them
+//	type              phone, tablet, tablet7, tablet10 or any
+//	density           a bucket name such as xhdpi or a dpi value
+//	sdk               an API level or name, compared with = < <= > >=
+//	version           the release version, compared with any operator
+//	manufacturer      a glob pattern, e.g. samsung*
+//	model             a glob pattern, e.g. "Pixel *"
+//	count             the most devices to select
+//
+// Any key containing a dot is a system property matched against a glob
+// pattern, as in "ro.product.cpu.abi=arm64-v8a".
+func ParseDeviceFilter(s string) (*DeviceFilter, error) {
+	filter := &DeviceFilter{}
+	for _, clause := range strings.Split(s, ";") {
+		clause = strings.TrimSpace(clause)
+		if clause == "" {
+			continue
+		}
+
+		key, op, value, ok := splitClause(clause)
+		if !ok {
+			return nil, fmt.Errorf("%w: %q: missing operator", ErrInvalidFilter, clause)
+		}
+		err := filter.set(key, op, value)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q: %v", ErrInvalidFilter, clause, err)
+		}
+	}
+	return filter, nil
+}
+
+func splitClause(clause string) (key, op, value string, ok bool) {
+	best := -1
+	for _, candidate := range filterOps {
+		i := strings.Index(clause, candidate)
+		if i < 0 {
+			continue
+		}
+		if best < 0 || i < best || i == best && len(candidate) > len(op) {
+			best = i
+			op = candidate
+		}
+	}
+	if best <= 0 {
+		return "", "", "", false
+	}
+	key = strings.TrimSpace(clause[:best])
+	value = strings.TrimSpace(clause[best+len(op):])
+	value = strings.Trim(value, `"'`)
+	return key, op, value, true
+}
+
+// set applies one clause. Built in keys are case-insensitive, while property
+// names are kept as written since properties are case-sensitive.
+func (f *DeviceFilter) set(key, op, value string) error {
+	if strings.Contains(key, ".") {
+		if op != "=" {
+			return errors.New("properties only support =")
+		}
+		if f.Properties == nil {
+			f.Properties = map[string]string{}
+		}
+		f.Properties[key] = value
+		return nil
+	}
+
+	key = strings.ToLower(key)
+	if key != "sdk" && key != "version" && op != "=" {
+		return fmt.Errorf("%s only supports =", key)
+	}
+
+	switch key {
+	case "serial", "serials":
+		value = strings.TrimSuffix(strings.TrimPrefix(value, "["), "]")
+		for _, serial := range strings.Split(value, ",") {
+			if serial = strings.TrimSpace(serial); serial != "" {
+				f.Serials = append(f.Serials, serial)
+			}
+		}
+	case "type":
+		t, ok := typeNames[strings.ToLower(value)]
+		if !ok {
+			return fmt.Errorf("unknown type %q", value)
+		}
+		f.Type = t
+	case "density":
+		d, ok := densityNames[strings.ToLower(value)]
+		if !ok {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("unknown density %q", value)
+			}
+			d = DensityBucket(n)
+		}
+		f.Density = d
+	case "sdk":
+		return f.setSdk(op, value)
+	case "version":
+		f.Versions = append(f.Versions, VersionConstraint{Op: op, Version: value})
+	case "manufacturer":
+		f.Manufacturer = value
+	case "model":
+		f.Model = value
+	case "count":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 0 {
+			return fmt.Errorf("invalid count %q", value)
+		}
+		f.Count = n
+	default:
+		return fmt.Errorf("unknown key %q", key)
+	}
+	return nil
+}
+
+func (f *DeviceFilter) setSdk(op, value string) error {
+	sdk, err := parseSdk(value)
+	if err != nil {
+		return err
+	}
+
+	switch op {
+	case "=":
+		f.MinSdk, f.MaxSdk = sdk, sdk
+	case ">=":
+		f.MinSdk = sdk
+	case ">":
+		f.MinSdk = sdk + 1
+	case "<=":
+		f.MaxSdk = sdk
+	case "<":
+		f.MaxSdk = sdk - 1
+	default:
+		return fmt.Errorf("sdk does not support %s", op)
+	}
+	return nil
+}
+
+// parseSdk accepts an API level or a name such as LOLLIPOP.
+func parseSdk(value string) (SdkVersion, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		return SdkVersion(n), nil
+	}
+	for sdk, name := range sdkMap {
+		if strings.EqualFold(name, value) {
+			return sdk, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown sdk %q", value)
+}
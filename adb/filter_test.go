@@ -0,0 +1,158 @@
+package adb
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceFilter(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   *DeviceFilter
+	}{
+		{"", &DeviceFilter{}},
+		{"serial=emulator-5554", &DeviceFilter{Serials: []string{"emulator-5554"}}},
+		{"serials=[a, b,c];", &DeviceFilter{Serials: []string{"a", "b", "c"}}},
+		{"type=tablet;count=5", &DeviceFilter{Type: TABLET, Count: 5}},
+		{"Type=Tablet10", &DeviceFilter{Type: TABLET_10}},
+		{"density=xhdpi", &DeviceFilter{Density: XHDPI}},
+		{"density=560", &DeviceFilter{Density: DensityBucket(560)}},
+		{"sdk=30", &DeviceFilter{MinSdk: R, MaxSdk: R}},
+		{"sdk>=lollipop;sdk<34", &DeviceFilter{MinSdk: LOLLIPOP, MaxSdk: TIRAMISU}},
+		{"sdk>28", &DeviceFilter{MinSdk: Q}},
+		{"version >= 4.1.1; version != 5", &DeviceFilter{Versions: []VersionConstraint{{">=", "4.1.1"}, {"!=", "5"}}}},
+		{`manufacturer=samsung*;model="Pixel *"`, &DeviceFilter{Manufacturer: "samsung*", Model: "Pixel *"}},
+		{"ro.product.cpu.abi=arm64-v8a", &DeviceFilter{Properties: map[string]string{"ro.product.cpu.abi": "arm64-v8a"}}},
+		{"persist.sys.Locale=en-*", &DeviceFilter{Properties: map[string]string{"persist.sys.Locale": "en-*"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			got, err := ParseDeviceFilter(tt.filter)
+			if err != nil {
+				t.Fatalf("ParseDeviceFilter() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseDeviceFilter() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseDeviceFilterErrors(t *testing.T) {
+	for _, filter := range []string{
+		"serial",
+		"=tablet",
+		"type=watch",
+		"type>=phone",
+		"density=huge",
+		"sdk=pancake",
+		"sdk!=30",
+		"count=-1",
+		"color=blue",
+		"ro.product.model>=Pixel",
+	} {
+		t.Run(filter, func(t *testing.T) {
+			_, err := ParseDeviceFilter(filter)
+			if !errors.Is(err, ErrInvalidFilter) {
+				t.Errorf("ParseDeviceFilter() error = %v, want ErrInvalidFilter", err)
+			}
+		})
+	}
+}
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"4.1.1", "4.1.1", 0},
+		{"4.1", "4.1.0", 0},
+		{"4.1.1", "4.1", 1},
+		{"4.0.4", "4.1", -1},
+		{"10", "9", 1},
+		{"8.1.0", "10", -1},
+		{"14", "14.0.0", 0},
+	}
+
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	phone := &Device{
+		Serial:       "emulator-5554",
+		Manufacturer: "Google",
+		Model:        "Pixel 6",
+		Sdk:          S,
+		Version:      "12",
+		Density:      XXHDPI,
+		Width:        1080,
+		Height:       2400,
+		Properties:   map[string]string{"persist.sys.Locale": "en-US"},
+	}
+	// 1200 pixels at xhdpi are 600dp.
+	tablet := &Device{
+		Serial:  "R52N",
+		Sdk:     TIRAMISU,
+		Version: "13",
+		Density: XHDPI,
+		Width:   1920,
+		Height:  1200,
+	}
+
+	tests := []struct {
+		device *Device
+		filter string
+		want   bool
+	}{
+		{phone, "", true},
+		{phone, "type=phone;sdk>=30;version>=11", true},
+		{phone, "type=tablet", false},
+		{phone, "manufacturer=goo*;model=pixel ?", true},
+		{phone, "model=Pixel 7", false},
+		{phone, "version<12", false},
+		{phone, "persist.sys.Locale=en-*", true},
+		{phone, "persist.sys.locale=en-*", false},
+		{phone, "serials=[a,emulator-5554]", true},
+		{tablet, "type=tablet", true},
+		{tablet, "type=tablet7", true},
+		{tablet, "type=tablet10", false},
+		{tablet, "type=phone", false},
+		{&Device{Width: 1920, Height: 1200}, "type=tablet", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.device.Serial+" "+tt.filter, func(t *testing.T) {
+			filter, err := ParseDeviceFilter(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := tt.device.MatchFilter(filter); got != tt.want {
+				t.Errorf("MatchFilter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseScreenSize(t *testing.T) {
+	tests := []struct {
+		out           string
+		width, height int64
+	}{
+		{"Physical size: 1080x2400\n", 1080, 2400},
+		{"Physical size: 1440x3120\nOverride size: 1080x2340\n", 1080, 2340},
+		{"/system/bin/sh: wm: not found\n", 0, 0},
+	}
+
+	for _, tt := range tests {
+		w, h := parseScreenSize(tt.out)
+		if w != tt.width || h != tt.height {
+			t.Errorf("parseScreenSize(%q) = %dx%d, want %dx%d", tt.out, w, h, tt.width, tt.height)
+		}
+	}
+}
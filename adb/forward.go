@@ -0,0 +1,235 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var ErrInvalidSpec = errors.New("adb: invalid forward spec")
+
+// Forward is an entry of the server's forward list. Local is the socket
+// listening on the host and Remote the one it is connected to on the device.
+type Forward struct {
+	Serial string `json:"serial"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+}
+
+// TcpSpec is a tcp port. As the listening side of a forward, port 0 lets
+// the server pick a free one.
+func TcpSpec(port int) string {
+	return fmt.Sprintf("tcp:%d", port)
+}
+
+// LocalAbstractSpec is a unix socket in the abstract namespace, as used by
+// Chrome DevTools ("chrome_devtools_remote").
+func LocalAbstractSpec(name string) string {
+	return "localabstract:" + name
+}
+
+func LocalReservedSpec(name string) string {
+	return "localreserved:" + name
+}
+
+func LocalFilesystemSpec(path string) string {
+	return "localfilesystem:" + path
+}
+
+// JdwpSpec is the debugger connection of the process with the given pid. It
+// is only valid on the device side.
+func JdwpSpec(pid int) string {
+	return fmt.Sprintf("jdwp:%d", pid)
+}
+
+// DevSpec is a character device on the device, such as a serial port.
+func DevSpec(path string) string {
+	return "dev:" + path
+}
+
+var specPrefixes = []string{"tcp:", "localabstract:", "localreserved:", "localfilesystem:", "jdwp:", "dev:"}
+
+// ValidateSpec checks that spec is a socket spec adb understands. jdwp: and
+// dev: only exist on the device, so they are rejected for the listening side.
+func ValidateSpec(spec string, listening bool) error {
+	for _, prefix := range specPrefixes {
+		if !strings.HasPrefix(spec, prefix) || len(spec) == len(prefix) {
+			continue
+		}
+		if listening && (prefix == "jdwp:" || prefix == "dev:") {
+			break
+		}
+		bits := 0
+		switch prefix {
+		case "tcp:":
+			bits = 16
+		case "jdwp:":
+			bits = 32
+		}
+		if bits != 0 {
+			if _, err := strconv.ParseUint(spec[len(prefix):], 10, bits); err != nil {
+				break
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("%w: %q", ErrInvalidSpec, spec)
+}
+
+// command sends a request that answers with a second status once it has
+// been carried out, as forward and killforward do.
+func (a *AdbConn) command(req string) error {
+	_, err := a.WriteCmd(req)
+	if err != nil {
+		return err
+	}
+	return a.VerifyOk()
+}
+
+// forward installs a forward or reverse and returns the tcp port of the
+// listening side. Only for tcp:0 does the server follow up with the port it
+// picked.
+func (a *AdbConn) forward(req, listen string) (int, error) {
+	err := a.command(req)
+	if err != nil {
+		return 0, err
+	}
+
+	switch {
+	case listen == "tcp:0":
+		port, err := a.readString()
+		if err != nil {
+			return 0, err
+		}
+		return strconv.Atoi(port)
+	case strings.HasPrefix(listen, "tcp:"):
+		return strconv.Atoi(listen[len("tcp:"):])
+	}
+	return 0, nil
+}
+
+func parseForwards(list string) []Forward {
+	var forwards []Forward
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		forwards = append(forwards, Forward{Serial: fields[0], Local: fields[1], Remote: fields[2]})
+	}
+	return forwards
+}
+
+// Forward forwards connections on the host's local socket to remote on the
+// device. With noRebind an existing forward of local is an error. For tcp
+// specs the local port is returned, which is how the port picked for tcp:0
+// is found out.
+func (d *Device) Forward(local, remote string, noRebind bool) (int, error) {
+	return d.ForwardContext(context.Background(), local, remote, noRebind)
+}
+
+func (d *Device) ForwardContext(ctx context.Context, local, remote string, noRebind bool) (int, error) {
+	if err := ValidateSpec(local, true); err != nil {
+		return 0, err
+	}
+	if err := ValidateSpec(remote, false); err != nil {
+		return 0, err
+	}
+
+	service := "forward:"
+	if noRebind {
+		service += "norebind:"
+	}
+	conn, err := d.DialContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return conn.forward(hostRequest(d, service+local+";"+remote), local)
+}
+
+// ListForwards returns the forwards of every device.
+func (adb *Adb) ListForwards() ([]Forward, error) {
+	return adb.ListForwardsContext(context.Background())
+}
+
+func (adb *Adb) ListForwardsContext(ctx context.Context) ([]Forward, error) {
+	list, err := adb.query(ctx, "host:list-forward")
+	if err != nil {
+		return nil, err
+	}
+	return parseForwards(list), nil
+}
+
+// ListForwards returns the forwards of this device.
+func (d *Device) ListForwards() ([]Forward, error) {
+	return d.ListForwardsContext(context.Background())
+}
+
+func (d *Device) ListForwardsContext(ctx context.Context) ([]Forward, error) {
+	list, err := d.query(ctx, "host:list-forward")
+	if err != nil {
+		return nil, err
+	}
+
+	var forwards []Forward
+	for _, f := range parseForwards(list) {
+		if f.Serial == d.Serial {
+			forwards = append(forwards, f)
+		}
+	}
+	return forwards, nil
+}
+
+// RemoveForward removes the forward listening on local.
+func (d *Device) RemoveForward(local string) error {
+	return d.RemoveForwardContext(context.Background(), local)
+}
+
+func (d *Device) RemoveForwardContext(ctx context.Context, local string) error {
+	conn, err := d.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.command(hostRequest(d, "killforward:"+local))
+}
+
+// RemoveAllForwards removes the forwards of this device. The server's own
+// killforward-all would drop those of every device.
+func (d *Device) RemoveAllForwards() error {
+	return d.RemoveAllForwardsContext(context.Background())
+}
+
+func (d *Device) RemoveAllForwardsContext(ctx context.Context) error {
+	forwards, err := d.ListForwardsContext(ctx)
+	if err != nil {
+		return err
+	}
+	for _, f := range forwards {
+		err = d.RemoveForwardContext(ctx, f.Local)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveAllForwards removes the forwards of every device.
+func (adb *Adb) RemoveAllForwards() error {
+	return adb.RemoveAllForwardsContext(context.Background())
+}
+
+func (adb *Adb) RemoveAllForwardsContext(ctx context.Context) error {
+	conn, err := adb.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.command("host:killforward-all")
+}
@@ -0,0 +1,293 @@
+package adb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// tmpDir is where APKs are pushed for the legacy install flow.
+const tmpDir = "/data/local/tmp"
+
+type InstallLocation int
+
+const (
+	InstallAuto InstallLocation = iota
+	InstallInternal
+	InstallExternal
+)
+
+type InstallMode int
+
+const (
+	// InstallModeAuto picks the best mode the device supports.
+	InstallModeAuto InstallMode = iota
+	// InstallModeLegacy pushes the APK to the device and runs pm install.
+	InstallModeLegacy
+	// InstallModeStreamed streams the APK into "cmd package install -S".
+	InstallModeStreamed
+	// InstallModeAbb streams the APK through the abb_exec service.
+	InstallModeAbb
+)
+
+type InstallOptions struct {
+	Replace          bool
+	Downgrade        bool
+	GrantPermissions bool
+	TestOnly         bool
+	Location         InstallLocation
+	Mode             InstallMode
+
+	// Parallelism limits how many devices InstallToDevices installs to at
+	// once. Zero means no limit.
+	Parallelism int
+}
+
+func (o *InstallOptions) args() []string {
+	var args []string
+	if o == nil {
+		return args
+	}
+	if o.Replace {
+		args = append(args, "-r")
+	}
+	if o.Downgrade {
+		args = append(args, "-d")
+	}
+	if o.GrantPermissions {
+		args = append(args, "-g")
+	}
+	if o.TestOnly {
+		args = append(args, "-t")
+	}
+	switch o.Location {
+	case InstallInternal:
+		args = append(args, "-f")
+	case InstallExternal:
+		args = append(args, "-s")
+	}
+	return args
+}
+
+var installFailureRegex = regexp.MustCompile(`Failure \[([A-Z0-9_]+)(?::\s*([^\]]*))?\]`)
+
+// InstallResult is the outcome reported by the package manager. Code holds
+// the failure code such as INSTALL_FAILED_VERSION_DOWNGRADE.
+type InstallResult struct {
+	Success bool   `json:"success"`
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+	Output  string `json:"output"`
+}
+
+// InstallError is returned alongside an unsuccessful InstallResult.
+type InstallError struct {
+	Result *InstallResult
+}
+
+func (e *InstallError) Error() string {
+	if e.Result.Code == "" {
+		return "adb: install failed: " + e.Result.Message
+	}
+	if e.Result.Message == "" {
+		return "adb: install failed: " + e.Result.Code
+	}
+	return fmt.Sprintf("adb: install failed: %s: %s", e.Result.Code, e.Result.Message)
+}
+
+func parseInstallResult(output string) *InstallResult {
+	result := &InstallResult{Output: output}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "Success") {
+			result.Success = true
+			return result
+		}
+	}
+
+	if match := installFailureRegex.FindStringSubmatch(output); match != nil {
+		result.Code = match[1]
+		result.Message = strings.TrimSpace(match[2])
+	} else {
+		result.Message = strings.TrimSpace(output)
+	}
+	return result
+}
+
+// err returns an *InstallError unless the install succeeded.
+func (r *InstallResult) err() error {
+	if r.Success {
+		return nil
+	}
+	return &InstallError{Result: r}
+}
+
+// Install installs the APK file. An install the package manager rejects
+// returns both the result and an *InstallError.
+func (d *Device) Install(apk string, opts *InstallOptions) (*InstallResult, error) {
+	return d.InstallContext(context.Background(), apk, opts)
+}
+
+func (d *Device) InstallContext(ctx context.Context, apk string, opts *InstallOptions) (*InstallResult, error) {
+	f, err := os.Open(apk)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	mode := d.installMode(ctx, opts)
+	var output string
+	if mode == InstallModeLegacy {
+		output, err = d.installLegacy(ctx, f, opts)
+	} else {
+		args := append([]string{"install", "-S", strconv.FormatInt(info.Size(), 10)}, opts.args()...)
+		output, err = d.packageStream(ctx, mode, f, args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result := parseInstallResult(output)
+	return result, result.err()
+}
+
+// DeviceInstallResult is the outcome of installing to one device of a
+// fleet. Result is nil if the install never reached the package manager.
+type DeviceInstallResult struct {
+	Device *Device
+	Result *InstallResult
+	Err    error
+}
+
+// InstallToDevices installs the APK on every device, running up to
+// opts.Parallelism installs at once. A failing device does not stop the
+// others; the results are returned in device order.
+func InstallToDevices(devices []*Device, apk string, opts *InstallOptions) []DeviceInstallResult {
+	return InstallToDevicesContext(context.Background(), devices, apk, opts)
+}
+
+func InstallToDevicesContext(ctx context.Context, devices []*Device, apk string, opts *InstallOptions) []DeviceInstallResult {
+	limit := len(devices)
+	if opts != nil && opts.Parallelism > 0 && opts.Parallelism < limit {
+		limit = opts.Parallelism
+	}
+
+	results := make([]DeviceInstallResult, len(devices))
+	sem := make(chan struct{}, limit)
+	var wg sync.WaitGroup
+	for i, d := range devices {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				results[i] = DeviceInstallResult{Device: d, Err: ctx.Err()}
+				return
+			}
+			defer func() { <-sem }()
+
+			result, err := d.InstallContext(ctx, apk, opts)
+			results[i] = DeviceInstallResult{Device: d, Result: result, Err: err}
+		}()
+	}
+	wg.Wait()
+	return results
+}
+
+// installMode resolves InstallModeAuto from the device's features, falling
+// back on its sdk level when the server cannot report them.
+func (d *Device) installMode(ctx context.Context, opts *InstallOptions) InstallMode {
+	if opts != nil && opts.Mode != InstallModeAuto {
+		return opts.Mode
+	}
+
+	features, err := d.FeaturesContext(ctx)
+	if err != nil {
+		if d.Sdk >= NOUGAT {
+			return InstallModeStreamed
+		}
+		return InstallModeLegacy
+	}
+	if features.Has(FeatureAbbExec) {
+		return InstallModeAbb
+	} else if features.Has(FeatureCmd) {
+		return InstallModeStreamed
+	}
+	return InstallModeLegacy
+}
+
+func (d *Device) installLegacy(ctx context.Context, f *os.File, opts *InstallOptions) (string, error) {
+	remote := path.Join(tmpDir, filepath.Base(f.Name()))
+	err := PushFileContext(ctx, []Transporter{d}, f, remote)
+	if err != nil {
+		return "", err
+	}
+	defer ShellSyncContext(ctx, d, "rm", "-f", shellQuote(remote))
+
+	args := append([]string{"pm", "install"}, opts.args()...)
+	out, err := ShellSyncContext(ctx, d, append(args, shellQuote(remote))...)
+	return string(out), err
+}
+
+// openPackageService starts "package <args>" through cmd or abb_exec and
+// returns the connection carrying its input and output.
+func (d *Device) openPackageService(ctx context.Context, mode InstallMode, args ...string) (*AdbConn, error) {
+	var service string
+	if mode == InstallModeAbb {
+		service = "abb_exec:" + strings.Join(append([]string{"package"}, args...), "\x00")
+	} else {
+		service = "exec:cmd package " + strings.Join(args, " ")
+	}
+
+	conn, err := dialTransport(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	_, err = conn.WriteCmd(service)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// packageStream runs "package <args>" with in as its input and returns
+// everything it printed.
+func (d *Device) packageStream(ctx context.Context, mode InstallMode, in io.Reader, args ...string) (string, error) {
+	conn, err := d.openPackageService(ctx, mode, args...)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	if in != nil {
+		_, err = io.Copy(conn, in)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	out, err := io.ReadAll(conn)
+	if err != nil && ctx.Err() != nil {
+		return "", ctx.Err()
+	}
+	return string(out), err
+}
+
+// shellQuote quotes s for the device shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
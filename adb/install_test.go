@@ -0,0 +1,61 @@
+package adb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseInstallResult(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   InstallResult
+	}{
+		{
+			name:   "success",
+			output: "Success\n",
+			want:   InstallResult{Success: true},
+		},
+		{
+			name:   "streamed success",
+			output: "Performing Streamed Install\nSuccess\n",
+			want:   InstallResult{Success: true},
+		},
+		{
+			name:   "session created",
+			output: "Success: created install session [1234]\n",
+			want:   InstallResult{Success: true},
+		},
+		{
+			name:   "failure with message",
+			output: "Failure [INSTALL_FAILED_VERSION_DOWNGRADE: Downgrade detected: Update version code 1 is older than current 2]\n",
+			want: InstallResult{
+				Code:    "INSTALL_FAILED_VERSION_DOWNGRADE",
+				Message: "Downgrade detected: Update version code 1 is older than current 2",
+			},
+		},
+		{
+			name:   "failure without message",
+			output: "Performing Push Install\nFailure [INSTALL_FAILED_ALREADY_EXISTS]\n",
+			want:   InstallResult{Code: "INSTALL_FAILED_ALREADY_EXISTS"},
+		},
+		{
+			name:   "unrecognised",
+			output: "  Error: java.lang.SecurityException\n",
+			want:   InstallResult{Message: "Error: java.lang.SecurityException"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseInstallResult(tt.output)
+			tt.want.Output = tt.output
+			if !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("parseInstallResult() = %+v, want %+v", *got, tt.want)
+			}
+			if (got.err() == nil) != tt.want.Success {
+				t.Errorf("err() = %v, want success %v", got.err(), tt.want.Success)
+			}
+		})
+	}
+}
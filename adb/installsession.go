@@ -0,0 +1,284 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// abandonTimeout bounds abandoning a failed session.
+const abandonTimeout = 10 * time.Second
+
+var installSessionRegex = regexp.MustCompile(`\[(\d+)\]`)
+
+// installSession is a package installer session on one device, created by
+// "pm install-create" and fed one APK at a time.
+type installSession struct {
+	device *Device
+	mode   InstallMode
+	id     string
+}
+
+// packageCommand runs "package <args>" through pm, cmd or abb_exec
+// depending on mode and returns its output.
+func (d *Device) packageCommand(ctx context.Context, mode InstallMode, args ...string) (string, error) {
+	if mode == InstallModeLegacy {
+		out, err := ShellSyncContext(ctx, d, append([]string{"pm"}, args...)...)
+		return string(out), err
+	}
+	return d.packageStream(ctx, mode, nil, args...)
+}
+
+func (d *Device) createInstallSession(ctx context.Context, opts *InstallOptions, size int64) (*installSession, error) {
+	mode := d.installMode(ctx, opts)
+	args := append([]string{"install-create", "-S", strconv.FormatInt(size, 10)}, opts.args()...)
+	out, err := d.packageCommand(ctx, mode, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	match := installSessionRegex.FindStringSubmatch(out)
+	if match == nil {
+		result := parseInstallResult(out)
+		return nil, &InstallError{Result: result}
+	}
+	return &installSession{device: d, mode: mode, id: match[1]}, nil
+}
+
+// apkWriter receives one APK of a session. The APK is added to the session
+// when the writer is closed; abort drops it without waiting on the device.
+type apkWriter interface {
+	io.WriteCloser
+	abort()
+}
+
+// writer returns the destination of the APK called name in the session.
+// modtime is given to the file pushed in legacy mode.
+func (s *installSession) writer(ctx context.Context, name string, size int64, modtime uint32) (apkWriter, error) {
+	sizeArg := strconv.FormatInt(size, 10)
+	if s.mode != InstallModeLegacy {
+		conn, err := s.device.openPackageService(ctx, s.mode, "install-write", "-S", sizeArg, s.id, name, "-")
+		if err != nil {
+			return nil, err
+		}
+		return &installWriter{conn: conn}, nil
+	}
+
+	remote := path.Join(tmpDir, fmt.Sprintf("install-%s-%s", s.id, name))
+	push, err := newPushWriter(ctx, s.device, remote, 0644, modtime)
+	if err != nil {
+		return nil, err
+	}
+	return &legacyInstallWriter{ctx: ctx, session: s, push: push, name: name, size: sizeArg, remote: remote}, nil
+}
+
+func (s *installSession) commit(ctx context.Context) (*InstallResult, error) {
+	out, err := s.device.packageCommand(ctx, s.mode, "install-commit", s.id)
+	if err != nil {
+		return nil, err
+	}
+	result := parseInstallResult(out)
+	return result, result.err()
+}
+
+// abandon discards the session. It runs even when ctx is already done, as
+// a cancelled install is the usual reason to abandon, but gives up after
+// abandonTimeout.
+func (s *installSession) abandon(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), abandonTimeout)
+	defer cancel()
+
+	_, err := s.device.packageCommand(ctx, s.mode, "install-abandon", s.id)
+	return err
+}
+
+// installWriter streams an APK into "install-write ... -" and checks the
+// package manager's answer on Close.
+type installWriter struct {
+	conn *AdbConn
+}
+
+func (w *installWriter) Write(b []byte) (int, error) {
+	return w.conn.Write(b)
+}
+
+func (w *installWriter) abort() {
+	w.conn.Close()
+}
+
+func (w *installWriter) Close() error {
+	defer w.conn.Close()
+
+	out, err := io.ReadAll(w.conn)
+	if err != nil {
+		return err
+	}
+	return parseInstallResult(string(out)).err()
+}
+
+// legacyInstallWriter pushes an APK to the device and adds the pushed file
+// to the session on Close.
+type legacyInstallWriter struct {
+	ctx     context.Context
+	session *installSession
+	push    *pushWriter
+	name    string
+	size    string
+	remote  string
+}
+
+func (w *legacyInstallWriter) Write(b []byte) (int, error) {
+	return w.push.Write(b)
+}
+
+func (w *legacyInstallWriter) abort() {
+	w.push.conn.Close()
+}
+
+func (w *legacyInstallWriter) Close() error {
+	err := w.push.Close()
+	if err != nil {
+		return err
+	}
+	d := w.session.device
+	defer ShellSyncContext(w.ctx, d, "rm", "-f", shellQuote(w.remote))
+
+	out, err := d.packageCommand(w.ctx, InstallModeLegacy, "install-write", "-S", w.size, w.session.id, shellQuote(w.name), shellQuote(w.remote))
+	if err != nil {
+		return err
+	}
+	return parseInstallResult(out).err()
+}
+
+// InstallMultiple installs an app made of several APKs, such as a base APK
+// and its configuration splits, in a single installer session. The session
+// is abandoned if any step fails.
+func (d *Device) InstallMultiple(apks []string, opts *InstallOptions) (*InstallResult, error) {
+	return d.InstallMultipleContext(context.Background(), apks, opts)
+}
+
+func (d *Device) InstallMultipleContext(ctx context.Context, apks []string, opts *InstallOptions) (*InstallResult, error) {
+	results, err := InstallMultipleToDevicesContext(ctx, []*Device{d}, apks, opts)
+	if len(results) == 0 {
+		return nil, err
+	}
+	return results[0], err
+}
+
+// InstallMultipleToDevices runs InstallMultiple on every device at once.
+// Like PushToDevices, each APK is read once and its data fanned out to all
+// devices. If writing fails on any device, every session is abandoned;
+// otherwise the commit results are returned in device order along with the
+// first failure.
+func InstallMultipleToDevices(devices []*Device, apks []string, opts *InstallOptions) ([]*InstallResult, error) {
+	return InstallMultipleToDevicesContext(context.Background(), devices, apks, opts)
+}
+
+func InstallMultipleToDevicesContext(ctx context.Context, devices []*Device, apks []string, opts *InstallOptions) ([]*InstallResult, error) {
+	if len(apks) == 0 {
+		return nil, errors.New("adb: no APKs to install")
+	}
+
+	var total int64
+	for _, apk := range apks {
+		info, err := os.Stat(apk)
+		if err != nil {
+			return nil, err
+		}
+		total += info.Size()
+	}
+
+	sessions := make([]*installSession, 0, len(devices))
+	abandon := func() {
+		for _, s := range sessions {
+			s.abandon(ctx)
+		}
+	}
+
+	for _, d := range devices {
+		s, err := d.createInstallSession(ctx, opts, total)
+		if err != nil {
+			abandon()
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+
+	for _, apk := range apks {
+		err := writeToSessions(ctx, sessions, apk)
+		if err != nil {
+			abandon()
+			return nil, err
+		}
+	}
+
+	var firstErr error
+	results := make([]*InstallResult, 0, len(sessions))
+	for _, s := range sessions {
+		result, err := s.commit(ctx)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+		results = append(results, result)
+	}
+	return results, firstErr
+}
+
+// writeToSessions streams one APK into every session.
+func writeToSessions(ctx context.Context, sessions []*installSession, apk string) error {
+	f, err := os.Open(apk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	name := strings.Replace(filepath.Base(apk), " ", "_", -1)
+	writers := make([]apkWriter, 0, len(sessions))
+	defer func() {
+		for _, w := range writers {
+			if w != nil {
+				w.abort()
+			}
+		}
+	}()
+
+	for _, s := range sessions {
+		w, err := s.writer(ctx, name, info.Size(), uint32(info.ModTime().Unix()))
+		if err != nil {
+			return err
+		}
+		writers = append(writers, w)
+	}
+
+	dests := make([]io.Writer, len(writers))
+	for i, w := range writers {
+		dests[i] = w
+	}
+	_, err = io.Copy(io.MultiWriter(dests...), f)
+	if err != nil {
+		return err
+	}
+
+	var firstErr error
+	for i, w := range writers {
+		err := w.Close()
+		writers[i] = nil
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,293 @@
+package adb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+var ErrLeaseLost = errors.New("adb: device lease lost")
+
+// LockStore holds the device locks shared by every DevicePool using it. A
+// lock belongs to its owner until it expires, after which anyone may take
+// it.
+type LockStore interface {
+	// TryLock takes the lock on key for ttl and reports whether it did.
+	TryLock(key, owner string, ttl time.Duration) (bool, error)
+	// Renew extends a lock held by owner, or returns ErrLeaseLost.
+	Renew(key, owner string, ttl time.Duration) error
+	// Unlock releases a lock held by owner. Unlocking a lock owned by
+	// someone else does nothing.
+	Unlock(key, owner string) error
+}
+
+// lockRecord is the content of a lock. A FileLockStore keeps the expiry in
+// the modification time of the lock file rather than in the file itself.
+type lockRecord struct {
+	Owner   string    `json:"owner"`
+	Host    string    `json:"host"`
+	PID     int       `json:"pid"`
+	Expires time.Time `json:"-"`
+}
+
+func newLockRecord(owner string, ttl time.Duration) lockRecord {
+	host, _ := os.Hostname()
+	return lockRecord{Owner: owner, Host: host, PID: os.Getpid(), Expires: time.Now().Add(ttl)}
+}
+
+func (r lockRecord) expired() bool {
+	return time.Now().After(r.Expires)
+}
+
+// MemoryLockStore shares locks between pools of one process.
+type MemoryLockStore struct {
+	mu    sync.Mutex
+	locks map[string]lockRecord
+}
+
+func NewMemoryLockStore() *MemoryLockStore {
+	return &MemoryLockStore{locks: map[string]lockRecord{}}
+}
+
+func (s *MemoryLockStore) TryLock(key, owner string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.locks[key]; ok && r.Owner != owner && !r.expired() {
+		return false, nil
+	}
+	s.locks[key] = newLockRecord(owner, ttl)
+	return true, nil
+}
+
+func (s *MemoryLockStore) Renew(key, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.locks[key]; !ok || r.Owner != owner {
+		return ErrLeaseLost
+	}
+	s.locks[key] = newLockRecord(owner, ttl)
+	return nil
+}
+
+func (s *MemoryLockStore) Unlock(key, owner string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r, ok := s.locks[key]; ok && r.Owner == owner {
+		delete(s.locks, key)
+	}
+	return nil
+}
+
+var lockNameRegex = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// FileLockStore keeps one JSON file per lock in a directory, so processes
+// sharing the directory agree on who holds each device. A lock expires at
+// the modification time of its file, which lets its owner renew it in place
+// without the file ever being rewritten or missing.
+type FileLockStore struct {
+	Dir string
+}
+
+// NewFileLockStore returns a store in dir, creating it if needed.
+func NewFileLockStore(dir string) (*FileLockStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileLockStore{Dir: dir}, nil
+}
+
+func (s *FileLockStore) path(key string) string {
+	return filepath.Join(s.Dir, lockNameRegex.ReplaceAllString(key, "_")+".lock")
+}
+
+func (s *FileLockStore) TryLock(key, owner string, ttl time.Duration) (bool, error) {
+	p := s.path(key)
+	ok, err := s.create(p, newLockRecord(owner, ttl))
+	if ok || err != nil {
+		return ok, err
+	}
+
+	info, r, err := s.read(p)
+	if os.IsNotExist(err) {
+		// Released since we tried; try again next time around.
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if r.Owner == owner {
+		err = s.Renew(key, owner, ttl)
+		if err == ErrLeaseLost {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if !r.expired() {
+		return false, nil
+	}
+
+	// Take the stale lock over. If what was moved aside is not the stale
+	// lock we saw, it was renewed or someone else already took it over.
+	stale, moved, err := s.moveAside(p)
+	if err != nil {
+		return false, nil
+	}
+	defer os.Remove(stale)
+
+	if !sameLock(info, moved) {
+		os.Link(stale, p)
+		return false, nil
+	}
+	return s.create(p, newLockRecord(owner, ttl))
+}
+
+// Renew moves the expiry of the lock file forward. The owner is checked
+// against the file that was renewed, so a lock taken over meanwhile is
+// reported lost rather than overwritten.
+func (s *FileLockStore) Renew(key, owner string, ttl time.Duration) error {
+	p := s.path(key)
+	info, r, err := s.read(p)
+	if os.IsNotExist(err) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return err
+	}
+	// An expired lock may be taken over at any moment, so it is not ours
+	// to renew any more.
+	if r.Owner != owner || r.expired() {
+		return ErrLeaseLost
+	}
+
+	expires := time.Now().Add(ttl)
+	err = os.Chtimes(p, expires, expires)
+	if os.IsNotExist(err) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return err
+	}
+
+	renewed, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return ErrLeaseLost
+	} else if err != nil {
+		return err
+	}
+	if !os.SameFile(info, renewed) {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Unlock moves the lock file aside before removing it, and puts it back if
+// it turns out to have been taken over since it was read.
+func (s *FileLockStore) Unlock(key, owner string) error {
+	p := s.path(key)
+	info, r, err := s.read(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if r.Owner != owner {
+		return nil
+	}
+
+	stale, moved, err := s.moveAside(p)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer os.Remove(stale)
+
+	if !os.SameFile(info, moved) {
+		os.Link(stale, p)
+	}
+	return nil
+}
+
+// moveAside renames the lock file to a name private to the caller. Only one
+// process can move a given file, so what was moved is the caller's alone to
+// inspect.
+func (s *FileLockStore) moveAside(p string) (string, os.FileInfo, error) {
+	stale := fmt.Sprintf("%s.%d.%d", p, os.Getpid(), time.Now().UnixNano())
+	err := os.Rename(p, stale)
+	if err != nil {
+		return "", nil, err
+	}
+
+	info, err := os.Stat(stale)
+	if err != nil {
+		os.Remove(stale)
+		return "", nil, err
+	}
+	return stale, info, nil
+}
+
+// sameLock reports whether two looks at a lock file saw the same lock,
+// unrenewed.
+func sameLock(a, b os.FileInfo) bool {
+	return os.SameFile(a, b) && a.ModTime().Equal(b.ModTime())
+}
+
+// create writes the lock file unless it already exists. The record is
+// written aside and linked into place, so the lock file is never seen
+// half written or without its expiry.
+func (s *FileLockStore) create(p string, r lockRecord) (bool, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return false, err
+	}
+	tmp := fmt.Sprintf("%s.%d.%d.tmp", p, os.Getpid(), time.Now().UnixNano())
+	defer os.Remove(tmp)
+
+	err = os.WriteFile(tmp, append(data, '\n'), 0644)
+	if err == nil {
+		err = os.Chtimes(tmp, r.Expires, r.Expires)
+	}
+	if err != nil {
+		return false, err
+	}
+
+	err = os.Link(tmp, p)
+	if os.IsExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// read returns the lock file's record along with the file it was read from.
+func (s *FileLockStore) read(p string) (os.FileInfo, lockRecord, error) {
+	var r lockRecord
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, r, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, r, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, r, err
+	}
+
+	// A corrupt record has no owner and so counts as stale.
+	if json.Unmarshal(data, &r) == nil && r.Owner != "" {
+		r.Expires = info.ModTime()
+	}
+	return info, r, nil
+}
@@ -0,0 +1,133 @@
+package adb
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func newTestLockStore(t *testing.T) *FileLockStore {
+	t.Helper()
+	s, err := NewFileLockStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestFileLockStoreCompeting(t *testing.T) {
+	s := newTestLockStore(t)
+
+	owners := []string{"a", "b"}
+	won := make([]bool, len(owners))
+	var wg sync.WaitGroup
+	for i, owner := range owners {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := s.TryLock("emulator-5554", owner, time.Hour)
+			if err != nil {
+				t.Error(err)
+			}
+			won[i] = ok
+		}()
+	}
+	wg.Wait()
+
+	if won[0] == won[1] {
+		t.Fatalf("a won %v, b won %v, want exactly one", won[0], won[1])
+	}
+	winner, loser := "a", "b"
+	if won[1] {
+		winner, loser = "b", "a"
+	}
+
+	if ok, err := s.TryLock("emulator-5554", winner, time.Hour); !ok || err != nil {
+		t.Errorf("TryLock() by the holder = %v, %v", ok, err)
+	}
+	if ok, _ := s.TryLock("emulator-5554", loser, time.Hour); ok {
+		t.Error("TryLock() of a held lock succeeded")
+	}
+
+	// Unlocking someone else's lock does nothing.
+	s.Unlock("emulator-5554", loser)
+	if ok, _ := s.TryLock("emulator-5554", loser, time.Hour); ok {
+		t.Error("Unlock() by another owner released the lock")
+	}
+	err := s.Unlock("emulator-5554", winner)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.TryLock("emulator-5554", loser, time.Hour); !ok || err != nil {
+		t.Errorf("TryLock() after Unlock() = %v, %v", ok, err)
+	}
+}
+
+func TestFileLockStoreTakeover(t *testing.T) {
+	s := newTestLockStore(t)
+
+	ok, err := s.TryLock("emulator-5554", "a", 10*time.Millisecond)
+	if !ok || err != nil {
+		t.Fatalf("TryLock() = %v, %v", ok, err)
+	}
+	time.Sleep(20 * time.Millisecond)
+
+	ok, err = s.TryLock("emulator-5554", "b", time.Hour)
+	if !ok || err != nil {
+		t.Fatalf("TryLock() of an expired lock = %v, %v", ok, err)
+	}
+	if err := s.Renew("emulator-5554", "a", time.Hour); err != ErrLeaseLost {
+		t.Errorf("Renew() by the previous owner = %v, want ErrLeaseLost", err)
+	}
+	s.Unlock("emulator-5554", "a")
+	if err := s.Renew("emulator-5554", "b", time.Hour); err != nil {
+		t.Errorf("Renew() by the new owner = %v", err)
+	}
+}
+
+func TestFileLockStoreRenewRacingTakeover(t *testing.T) {
+	s := newTestLockStore(t)
+	const ttl = 5 * time.Millisecond
+
+	for i := 0; i < 100; i++ {
+		s.Unlock("emulator-5554", "a")
+		s.Unlock("emulator-5554", "b")
+		ok, err := s.TryLock("emulator-5554", "a", ttl)
+		if !ok || err != nil {
+			t.Fatalf("TryLock() = %v, %v", ok, err)
+		}
+		// Race a late renewal against a takeover around the expiry.
+		time.Sleep(ttl - 500*time.Microsecond)
+
+		var renewErr error
+		var took bool
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			renewErr = s.Renew("emulator-5554", "a", time.Hour)
+		}()
+		go func() {
+			defer wg.Done()
+			for start := time.Now(); !took && time.Since(start) < 2*ttl; {
+				took, _ = s.TryLock("emulator-5554", "b", time.Hour)
+			}
+		}()
+		wg.Wait()
+
+		if took && renewErr != ErrLeaseLost {
+			t.Fatalf("b took the lock over but a's Renew() = %v, want ErrLeaseLost", renewErr)
+		}
+		_, r, err := s.read(s.path("emulator-5554"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "a"
+		if took {
+			want = "b"
+		}
+		if r.Owner != want {
+			t.Fatalf("lock owned by %q, want %q", r.Owner, want)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var ErrPackageNotFound = errors.New("adb: package not found")
+
+// PackageError is returned when the package manager refuses a pm command.
+type PackageError struct {
+	// Command is the pm command that failed, e.g. "uninstall".
+	Command string
+	// Message is what pm printed, e.g. "Failure [DELETE_FAILED_INTERNAL_ERROR]".
+	Message string
+}
+
+func (e *PackageError) Error() string {
+	return "adb: pm " + e.Command + ": " + e.Message
+}
+
+// PackageFilter narrows ListPackages the same way pm's flags do. Name
+// matches any package containing it.
+type PackageFilter struct {
+	ThirdParty bool
+	System     bool
+	Enabled    bool
+	Disabled   bool
+	Name       string
+}
+
+func (f *PackageFilter) args() []string {
+	var args []string
+	if f == nil {
+		return args
+	}
+	if f.ThirdParty {
+		args = append(args, "-3")
+	}
+	if f.System {
+		args = append(args, "-s")
+	}
+	if f.Enabled {
+		args = append(args, "-e")
+	}
+	if f.Disabled {
+		args = append(args, "-d")
+	}
+	if f.Name != "" {
+		args = append(args, shellQuote(f.Name))
+	}
+	return args
+}
+
+// Package is an entry of ListPackages. UID is only reported from OREO on.
+type Package struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	UID       int    `json:"uid,omitempty"`
+	Installer string `json:"installer,omitempty"`
+}
+
+// PackageInfo is the state of an installed package as reported by
+// "dumpsys package".
+type PackageInfo struct {
+	Name                 string   `json:"name"`
+	UID                  int      `json:"uid"`
+	VersionCode          int64    `json:"version_code"`
+	VersionName          string   `json:"version_name"`
+	MinSdk               int      `json:"min_sdk,omitempty"`
+	TargetSdk            int      `json:"target_sdk,omitempty"`
+	CodePath             string   `json:"code_path"`
+	Installer            string   `json:"installer,omitempty"`
+	FirstInstallTime     string   `json:"first_install_time,omitempty"`
+	LastUpdateTime       string   `json:"last_update_time,omitempty"`
+	Enabled              bool     `json:"enabled"`
+	RequestedPermissions []string `json:"requested_permissions,omitempty"`
+	GrantedPermissions   []string `json:"granted_permissions,omitempty"`
+}
+
+// pm runs "pm <args>" and returns its trimmed output. A non-zero exit status
+// or a Failure/Error answer is returned as a *PackageError.
+func (d *Device) pm(ctx context.Context, args ...string) (string, error) {
+	out, err := Command(d, append([]string{"pm"}, args...)...).OutputContext(ctx)
+	output := strings.TrimSpace(string(out))
+
+	var ee *ExitError
+	if errors.As(err, &ee) {
+		msg := strings.TrimSpace(string(ee.Stderr))
+		if msg == "" {
+			msg = output
+		}
+		return output, &PackageError{Command: args[0], Message: msg}
+	} else if err != nil {
+		return output, err
+	}
+
+	if pmFailed(output) {
+		return output, &PackageError{Command: args[0], Message: output}
+	}
+	return output, nil
+}
+
+// pmFailed reports whether pm answered with an error. Some versions exit 0
+// after printing "Failure [...]", "Error: ..." or, for an uncaught
+// exception, "Exception occurred while executing '...':".
+func pmFailed(output string) bool {
+	if strings.HasPrefix(output, "Failure") || strings.HasPrefix(output, "Error") {
+		return true
+	}
+	for _, line := range strings.Split(output, "\n") {
+		if strings.HasPrefix(line, "Exception occurred") {
+			return true
+		}
+	}
+	return false
+}
+
+// ListPackages returns the installed packages matching filter, which may be
+// nil to list everything.
+func (d *Device) ListPackages(filter *PackageFilter) ([]Package, error) {
+	return d.ListPackagesContext(context.Background(), filter)
+}
+
+func (d *Device) ListPackagesContext(ctx context.Context, filter *PackageFilter) ([]Package, error) {
+	args := []string{"list", "packages", "-f", "-i"}
+	if d.Sdk >= OREO {
+		args = append(args, "-U")
+	}
+
+	out, err := d.pm(ctx, append(args, filter.args()...)...)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackages(out), nil
+}
+
+// parsePackages parses lines such as
+// "package:/data/app/com.foo-1/base.apk=com.foo uid:10123 installer=null".
+func parsePackages(out string) []Package {
+	var packages []Package
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || !strings.HasPrefix(fields[0], "package:") {
+			continue
+		}
+
+		var p Package
+		entry := strings.TrimPrefix(fields[0], "package:")
+		if i := strings.LastIndex(entry, "="); i >= 0 {
+			p.Path, p.Name = entry[:i], entry[i+1:]
+		} else {
+			p.Name = entry
+		}
+
+		for _, field := range fields[1:] {
+			if uid, ok := strings.CutPrefix(field, "uid:"); ok {
+				p.UID, _ = strconv.Atoi(uid)
+			} else if installer, ok := strings.CutPrefix(field, "installer="); ok && installer != "null" {
+				p.Installer = installer
+			}
+		}
+		packages = append(packages, p)
+	}
+	return packages
+}
+
+// HasPackage reports whether the third party package pack is installed.
+func (d *Device) HasPackage(pack string) (bool, error) {
+	packages, err := d.ListPackages(&PackageFilter{ThirdParty: true, Name: pack})
+	if err != nil {
+		return false, err
+	}
+	for _, p := range packages {
+		if p.Name == pack {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Uninstall removes the package. With keepData its data and cache
+// directories are left on the device.
+func (d *Device) Uninstall(pkg string, keepData bool) error {
+	return d.UninstallContext(context.Background(), pkg, keepData)
+}
+
+func (d *Device) UninstallContext(ctx context.Context, pkg string, keepData bool) error {
+	args := []string{"uninstall"}
+	if keepData {
+		args = append(args, "-k")
+	}
+	_, err := d.pm(ctx, append(args, pkg)...)
+	return err
+}
+
+// ClearData deletes all data of the package.
+func (d *Device) ClearData(pkg string) error {
+	return d.ClearDataContext(context.Background(), pkg)
+}
+
+func (d *Device) ClearDataContext(ctx context.Context, pkg string) error {
+	out, err := d.pm(ctx, "clear", pkg)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(out, "Success") {
+		return &PackageError{Command: "clear", Message: out}
+	}
+	return nil
+}
+
+func (d *Device) Enable(pkg string) error {
+	return d.EnableContext(context.Background(), pkg)
+}
+
+func (d *Device) EnableContext(ctx context.Context, pkg string) error {
+	_, err := d.pm(ctx, "enable", pkg)
+	return err
+}
+
+// Disable disables the package for the current user, as the Settings app
+// would.
+func (d *Device) Disable(pkg string) error {
+	return d.DisableContext(context.Background(), pkg)
+}
+
+func (d *Device) DisableContext(ctx context.Context, pkg string) error {
+	_, err := d.pm(ctx, "disable-user", pkg)
+	return err
+}
+
+// GrantPermission grants a runtime permission such as
+// android.permission.CAMERA to the package.
+func (d *Device) GrantPermission(pkg, permission string) error {
+	return d.GrantPermissionContext(context.Background(), pkg, permission)
+}
+
+func (d *Device) GrantPermissionContext(ctx context.Context, pkg, permission string) error {
+	_, err := d.pm(ctx, "grant", pkg, permission)
+	return err
+}
+
+func (d *Device) RevokePermission(pkg, permission string) error {
+	return d.RevokePermissionContext(context.Background(), pkg, permission)
+}
+
+func (d *Device) RevokePermissionContext(ctx context.Context, pkg, permission string) error {
+	_, err := d.pm(ctx, "revoke", pkg, permission)
+	return err
+}
+
+// PackageInfo returns the state of the installed package, or
+// ErrPackageNotFound.
+func (d *Device) PackageInfo(pkg string) (*PackageInfo, error) {
+	return d.PackageInfoContext(context.Background(), pkg)
+}
+
+func (d *Device) PackageInfoContext(ctx context.Context, pkg string) (*PackageInfo, error) {
+	out, err := Command(d, "dumpsys", "package", pkg).OutputContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return parsePackageInfo(pkg, string(out))
+}
+
+// parsePackageInfo reads the "Package [pkg]" block of dumpsys package. The
+// block ends at the first line indented no deeper than its header, which
+// skips the hidden system package entry that may follow it.
+func parsePackageInfo(pkg, out string) (*PackageInfo, error) {
+	info := &PackageInfo{Name: pkg, Enabled: true}
+	found := false
+	blockIndent := 0
+	section := ""
+	sectionIndent := 0
+	enabledSeen := false
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		if !found {
+			if strings.HasPrefix(trimmed, "Package ["+pkg+"]") {
+				found = true
+				blockIndent = indent
+			}
+			continue
+		}
+		if indent <= blockIndent {
+			break
+		}
+
+		if section != "" && indent > sectionIndent {
+			name, _, _ := strings.Cut(trimmed, ":")
+			name, _, _ = strings.Cut(name, ",")
+			switch section {
+			case "requested permissions:":
+				info.RequestedPermissions = append(info.RequestedPermissions, name)
+			case "install permissions:", "runtime permissions:":
+				if strings.Contains(trimmed, "granted=true") {
+					info.GrantedPermissions = append(info.GrantedPermissions, name)
+				}
+			}
+			continue
+		}
+		section = ""
+		if strings.HasSuffix(trimmed, "permissions:") {
+			section = trimmed
+			sectionIndent = indent
+			continue
+		}
+
+		key, value, _ := strings.Cut(trimmed, "=")
+		switch key {
+		case "versionName":
+			info.VersionName = value
+			continue
+		case "codePath":
+			info.CodePath = value
+			continue
+		case "firstInstallTime":
+			info.FirstInstallTime = value
+			continue
+		case "lastUpdateTime":
+			info.LastUpdateTime = value
+			continue
+		case "installerPackageName":
+			if value != "null" {
+				info.Installer = value
+			}
+			continue
+		}
+
+		for _, field := range strings.Fields(trimmed) {
+			key, value, ok := strings.Cut(field, "=")
+			if !ok {
+				continue
+			}
+			switch key {
+			case "userId", "appId":
+				info.UID, _ = strconv.Atoi(value)
+			case "versionCode":
+				info.VersionCode, _ = strconv.ParseInt(value, 10, 64)
+			case "minSdk":
+				info.MinSdk, _ = strconv.Atoi(value)
+			case "targetSdk":
+				info.TargetSdk, _ = strconv.Atoi(value)
+			case "enabled":
+				// 2, 3 and 4 are the disabled states of the first user.
+				if !enabledSeen {
+					state, _ := strconv.Atoi(value)
+					info.Enabled = state < 2 || state > 4
+					enabledSeen = true
+				}
+			}
+		}
+	}
+
+	if !found {
+		return nil, ErrPackageNotFound
+	}
+	return info, nil
+}
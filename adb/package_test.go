@@ -0,0 +1,158 @@
+package adb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePackages(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want []Package
+	}{
+		{
+			name: "empty",
+			out:  "",
+			want: nil,
+		},
+		{
+			name: "names",
+			out:  "package:com.android.settings\npackage:com.example.app\n",
+			want: []Package{{Name: "com.android.settings"}, {Name: "com.example.app"}},
+		},
+		{
+			name: "paths uids and installers",
+			out: "package:/data/app/~~abc==/com.example.app-xyz==/base.apk=com.example.app uid:10123 installer=com.android.vending\n" +
+				"package:/system/app/Settings/Settings.apk=com.android.settings uid:1000 installer=null\n",
+			want: []Package{
+				{Name: "com.example.app", Path: "/data/app/~~abc==/com.example.app-xyz==/base.apk", UID: 10123, Installer: "com.android.vending"},
+				{Name: "com.android.settings", Path: "/system/app/Settings/Settings.apk", UID: 1000},
+			},
+		},
+		{
+			name: "noise",
+			out:  "WARNING: linker: something\r\npackage:com.example.app\r\n\r\n",
+			want: []Package{{Name: "com.example.app"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parsePackages(tt.out)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePackages() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+const dumpsysPackage = `Activity Resolver Table:
+  Non-Data Actions:
+      android.intent.action.MAIN:
+        1b2c3d4 com.example.app/.MainActivity filter 5e6f7a8
+Packages:
+  Package [com.example.app] (a1b2c3d):
+    userId=10123
+    pkg=Package{e4f5a6b com.example.app}
+    codePath=/data/app/~~abc==/com.example.app-xyz==
+    versionCode=42 minSdk=21 targetSdk=34
+    versionName=1.2.3
+    flags=[ HAS_CODE ALLOW_CLEAR_USER_DATA ]
+    timeStamp=2024-01-02 03:04:05
+    firstInstallTime=2024-01-02 03:04:06
+    lastUpdateTime=2024-01-03 03:04:06
+    installerPackageName=com.android.vending
+    requested permissions:
+      android.permission.INTERNET
+      android.permission.CAMERA
+      android.permission.ACCESS_NETWORK_STATE
+    install permissions:
+      android.permission.INTERNET: granted=true
+      android.permission.ACCESS_NETWORK_STATE: granted=true
+    User 0: ceDataInode=1234 installed=true hidden=false suspended=false stopped=false notLaunched=false enabled=0 instant=false virtual=false
+      runtime permissions:
+        android.permission.CAMERA: granted=false, flags=[ USER_SET ]
+  Package [com.example.other] (f0e1d2c):
+    userId=10124
+    versionCode=1 minSdk=21 targetSdk=34
+    User 0: ceDataInode=5678 installed=true enabled=3
+`
+
+func TestParsePackageInfo(t *testing.T) {
+	tests := []struct {
+		name    string
+		pkg     string
+		want    *PackageInfo
+		wantErr error
+	}{
+		{
+			name: "full",
+			pkg:  "com.example.app",
+			want: &PackageInfo{
+				Name:                 "com.example.app",
+				UID:                  10123,
+				VersionCode:          42,
+				VersionName:          "1.2.3",
+				MinSdk:               21,
+				TargetSdk:            34,
+				CodePath:             "/data/app/~~abc==/com.example.app-xyz==",
+				Installer:            "com.android.vending",
+				FirstInstallTime:     "2024-01-02 03:04:06",
+				LastUpdateTime:       "2024-01-03 03:04:06",
+				Enabled:              true,
+				RequestedPermissions: []string{"android.permission.INTERNET", "android.permission.CAMERA", "android.permission.ACCESS_NETWORK_STATE"},
+				GrantedPermissions:   []string{"android.permission.INTERNET", "android.permission.ACCESS_NETWORK_STATE"},
+			},
+		},
+		{
+			name: "disabled by user",
+			pkg:  "com.example.other",
+			want: &PackageInfo{
+				Name:        "com.example.other",
+				UID:         10124,
+				VersionCode: 1,
+				MinSdk:      21,
+				TargetSdk:   34,
+			},
+		},
+		{
+			name:    "missing",
+			pkg:     "com.example.missing",
+			wantErr: ErrPackageNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parsePackageInfo(tt.pkg, dumpsysPackage)
+			if err != tt.wantErr {
+				t.Fatalf("parsePackageInfo() error = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parsePackageInfo() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPmFailed(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"Success", false},
+		{"package:com.example.ExceptionHandler\npackage:com.example.app", false},
+		{"package:/data/app/NoExceptions/base.apk=com.example.noexceptions", false},
+		{"Failure [not installed for 0]", true},
+		{"Error: Unknown option: -x", true},
+		{"Exception occurred while executing 'grant':\njava.lang.SecurityException: Package com.foo has not requested permission", true},
+		{"WARNING: linker: something\nException occurred while executing 'list':", true},
+	}
+
+	for _, tt := range tests {
+		if got := pmFailed(tt.output); got != tt.want {
+			t.Errorf("pmFailed(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package adb
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	defaultLeaseTTL     = time.Minute
+	defaultPollInterval = 5 * time.Second
+)
+
+// DevicePool hands out devices of one adb server to jobs that must not use
+// the same device at once. Pools in several processes agree through a
+// shared LockStore such as a FileLockStore.
+type DevicePool struct {
+	Adb   *Adb
+	Store LockStore
+
+	// Owner identifies this pool's leases in the store. It defaults to a
+	// value unique to the pool.
+	Owner string
+	// TTL is how long a lease outlives its holder. Leases are renewed
+	// while held, so a crashed holder releases its devices after at most
+	// TTL. Zero means a minute.
+	TTL time.Duration
+	// PollInterval is how often Acquire looks for free devices. Zero means
+	// every five seconds.
+	PollInterval time.Duration
+
+	// Defaults for a pool built without NewDevicePool.
+	once         sync.Once
+	defaultOwner string
+}
+
+func NewDevicePool(adb *Adb, store LockStore) *DevicePool {
+	return &DevicePool{
+		Adb:          adb,
+		Store:        store,
+		Owner:        newOwner(),
+		TTL:          defaultLeaseTTL,
+		PollInterval: defaultPollInterval,
+	}
+}
+
+func newOwner() string {
+	host, _ := os.Hostname()
+	id := make([]byte, 4)
+	rand.Read(id)
+	return fmt.Sprintf("%s:%d:%s", host, os.Getpid(), hex.EncodeToString(id))
+}
+
+func (p *DevicePool) owner() string {
+	if p.Owner != "" {
+		return p.Owner
+	}
+	p.once.Do(func() {
+		p.defaultOwner = newOwner()
+	})
+	return p.defaultOwner
+}
+
+func (p *DevicePool) ttl() time.Duration {
+	if p.TTL > 0 {
+		return p.TTL
+	}
+	return defaultLeaseTTL
+}
+
+func (p *DevicePool) pollInterval() time.Duration {
+	if p.PollInterval > 0 {
+		return p.PollInterval
+	}
+	return defaultPollInterval
+}
+
+// Acquire blocks until n devices matching filter are free and returns a
+// lease on each. Devices are taken all at once or not at all, so jobs
+// waiting for several devices do not starve each other.
+func (p *DevicePool) Acquire(ctx context.Context, filter *DeviceFilter, n int) ([]*Lease, error) {
+	var list *DeviceFilter
+	if filter != nil {
+		// Count must not hide free devices behind busy ones.
+		f := *filter
+		f.Count = 0
+		list = &f
+	}
+
+	for {
+		devices, err := p.Adb.ListDevicesContext(ctx, list)
+		if err != nil {
+			return nil, err
+		}
+
+		leases, err := p.tryAcquire(devices, n)
+		if err != nil || leases != nil {
+			return leases, err
+		}
+
+		select {
+		case <-time.After(p.pollInterval()):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryAcquire locks n of devices, or none and returns nil.
+func (p *DevicePool) tryAcquire(devices []*Device, n int) ([]*Lease, error) {
+	if len(devices) < n {
+		return nil, nil
+	}
+
+	locked := make([]*Device, 0, n)
+	unlock := func() {
+		for _, d := range locked {
+			p.Store.Unlock(d.Serial, p.owner())
+		}
+	}
+
+	for _, d := range devices {
+		if len(locked) == n {
+			break
+		}
+		ok, err := p.Store.TryLock(d.Serial, p.owner(), p.ttl())
+		if err != nil {
+			unlock()
+			return nil, err
+		}
+		if ok {
+			locked = append(locked, d)
+		}
+	}
+	if len(locked) < n {
+		unlock()
+		return nil, nil
+	}
+
+	leases := make([]*Lease, 0, n)
+	for _, d := range locked {
+		leases = append(leases, p.newLease(d))
+	}
+	return leases, nil
+}
+
+// Lease is a device held from a DevicePool. It is renewed in the background
+// until released or lost.
+type Lease struct {
+	Device *Device
+
+	pool *DevicePool
+	stop chan struct{}
+	lost chan struct{}
+	once sync.Once
+
+	mu  sync.Mutex
+	err error
+}
+
+func (p *DevicePool) newLease(d *Device) *Lease {
+	l := &Lease{Device: d, pool: p, stop: make(chan struct{}), lost: make(chan struct{})}
+	go l.renew()
+	return l
+}
+
+func (l *Lease) renew() {
+	ticker := time.NewTicker(l.pool.ttl() / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+
+		err := l.pool.Store.Renew(l.Device.Serial, l.pool.owner(), l.pool.ttl())
+		if err == ErrLeaseLost {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// Lost is closed when the lease could not be renewed and the device may
+// have been handed to someone else.
+func (l *Lease) Lost() <-chan struct{} {
+	return l.lost
+}
+
+// Err returns ErrLeaseLost once the lease is lost.
+func (l *Lease) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// Release stops renewing the lease and frees the device. It is safe to call
+// more than once.
+func (l *Lease) Release() error {
+	var err error
+	l.once.Do(func() {
+		close(l.stop)
+		err = l.pool.Store.Unlock(l.Device.Serial, l.pool.owner())
+	})
+	return err
+}
+
+// ReleaseAll releases every lease, returning the first error.
+func ReleaseAll(leases []*Lease) error {
+	var firstErr error
+	for _, l := range leases {
+		err := l.Release()
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,347 @@
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+var ErrReplayMismatch = errors.New("adb: replay mismatch")
+
+// recordEvent is one line of a recording.
+type recordEvent struct {
+	Conn int    `json:"conn"`
+	Op   string `json:"op"`
+	Data []byte `json:"data,omitempty"`
+}
+
+// Recorder writes the traffic of every connection made through its Dialer
+// to w, one JSON event per line, for a Replayer to serve back later.
+type Recorder struct {
+	mu   sync.Mutex
+	enc  *json.Encoder
+	next int
+	err  error
+}
+
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Dialer returns a copy of d whose connections are recorded.
+func (r *Recorder) Dialer(d Dialer) Dialer {
+	dial := d.NetDial
+	if dial == nil {
+		var nd net.Dialer
+		dial = nd.DialContext
+	}
+
+	d.NetDial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		r.mu.Lock()
+		r.next++
+		id := r.next
+		r.mu.Unlock()
+
+		r.record(recordEvent{Conn: id, Op: "dial"})
+		return &recordingConn{Conn: c, recorder: r, id: id}, nil
+	}
+	return d
+}
+
+// Err returns the first error writing the recording.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.err
+}
+
+func (r *Recorder) record(e recordEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(e); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+type recordingConn struct {
+	net.Conn
+	recorder *Recorder
+	id       int
+	once     sync.Once
+}
+
+func (c *recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.recorder.record(recordEvent{Conn: c.id, Op: "read", Data: append([]byte(nil), b[:n]...)})
+	}
+	return n, err
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.recorder.record(recordEvent{Conn: c.id, Op: "write", Data: append([]byte(nil), b[:n]...)})
+	}
+	return n, err
+}
+
+func (c *recordingConn) Close() error {
+	c.once.Do(func() {
+		c.recorder.record(recordEvent{Conn: c.id, Op: "close"})
+	})
+	return c.Conn.Close()
+}
+
+// recordedConn is the script of one recorded connection: everything the
+// client wrote, and each read along with how much had been written before
+// it.
+type recordedConn struct {
+	id     int
+	writes []byte
+	reads  []recordedRead
+	used   bool
+}
+
+func (c *recordedConn) replies() []byte {
+	var b []byte
+	for _, r := range c.reads {
+		b = append(b, r.data...)
+	}
+	return b
+}
+
+type recordedRead struct {
+	after int
+	data  []byte
+}
+
+// Replayer serves a recording back without an adb server. A connection is
+// matched to the first unused recorded one that starts with its first
+// write, so concurrent requests replay correctly whatever order they are
+// dialed in. Writes that stray from the recording fail with
+// ErrReplayMismatch.
+type Replayer struct {
+	mu    sync.Mutex
+	conns []*recordedConn
+	err   error
+}
+
+func NewReplayer(r io.Reader) (*Replayer, error) {
+	p := &Replayer{}
+	byID := map[int]*recordedConn{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 16*1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var e recordEvent
+		err := json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			return nil, err
+		}
+
+		c, ok := byID[e.Conn]
+		if !ok {
+			c = &recordedConn{id: e.Conn}
+			byID[e.Conn] = c
+			p.conns = append(p.conns, c)
+		}
+		switch e.Op {
+		case "write":
+			c.writes = append(c.writes, e.Data...)
+		case "read":
+			c.reads = append(c.reads, recordedRead{after: len(c.writes), data: e.Data})
+		}
+	}
+	return p, scanner.Err()
+}
+
+// Dialer returns a Dialer whose connections are served from the recording.
+func (p *Replayer) Dialer() Dialer {
+	return Dialer{
+		Host: "replay",
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c := &replayConn{replayer: p}
+			c.cond = sync.NewCond(&c.mu)
+			return c, nil
+		},
+	}
+}
+
+// Err returns the first mismatch, or an error naming the recorded
+// connections that were never replayed.
+func (p *Replayer) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return p.err
+	}
+	var unused []int
+	for _, c := range p.conns {
+		if !c.used {
+			unused = append(unused, c.id)
+		}
+	}
+	if len(unused) > 0 {
+		return fmt.Errorf("adb: recorded connections %v were not replayed", unused)
+	}
+	return nil
+}
+
+// claim picks the script for a connection that has written written and read
+// the first consumed bytes of prev's replies, releasing prev. Connections
+// that start alike can so move to another script once they diverge.
+func (p *Replayer) claim(prev *recordedConn, written []byte, consumed int) *recordedConn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var replies []byte
+	if prev != nil {
+		replies = prev.replies()[:consumed]
+	}
+	for _, c := range p.conns {
+		if c.used || !bytes.HasPrefix(c.writes, written) || !bytes.HasPrefix(c.replies(), replies) {
+			continue
+		}
+		if prev != nil {
+			prev.used = false
+		}
+		c.used = true
+		return c
+	}
+	return nil
+}
+
+func (p *Replayer) mismatch(format string, args ...interface{}) error {
+	err := fmt.Errorf("%w: "+format, append([]interface{}{ErrReplayMismatch}, args...)...)
+	p.mu.Lock()
+	if p.err == nil {
+		p.err = err
+	}
+	p.mu.Unlock()
+	return err
+}
+
+type replayConn struct {
+	replayer *Replayer
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	script   *recordedConn
+	written  []byte
+	consumed int
+	read     int
+	offset   int
+	closed   bool
+	err      error
+}
+
+func (c *replayConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, net.ErrClosed
+	} else if c.err != nil {
+		return 0, c.err
+	}
+	written := append(c.written[:len(c.written):len(c.written)], b...)
+	if c.script == nil || !bytes.HasPrefix(c.script.writes, written) {
+		script := c.replayer.claim(c.script, written, c.consumed)
+		if script == nil {
+			// Fail reads too, as the client may not check its writes.
+			c.err = c.replayer.mismatch("no recorded connection continues with %q after %d bytes", b, len(c.written))
+			c.cond.Broadcast()
+			return 0, c.err
+		}
+		c.script = script
+		c.seek()
+	}
+
+	c.written = written
+	c.cond.Broadcast()
+	return len(b), nil
+}
+
+// seek positions the next read after the consumed bytes of the script.
+func (c *replayConn) seek() {
+	c.read, c.offset = 0, c.consumed
+	for c.read < len(c.script.reads) && c.offset >= len(c.script.reads[c.read].data) {
+		c.offset -= len(c.script.reads[c.read].data)
+		c.read++
+	}
+}
+
+// Read returns the next recorded read once everything written before it
+// in the recording has been written again.
+func (c *replayConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if c.closed {
+			return 0, net.ErrClosed
+		} else if c.err != nil {
+			return 0, c.err
+		}
+		if c.script != nil {
+			if c.read == len(c.script.reads) {
+				return 0, io.EOF
+			}
+			r := c.script.reads[c.read]
+			if len(c.written) >= r.after {
+				n := copy(b, r.data[c.offset:])
+				c.offset += n
+				c.consumed += n
+				if c.offset == len(r.data) {
+					c.read++
+					c.offset = 0
+				}
+				return n, nil
+			}
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *replayConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	c.cond.Broadcast()
+	return nil
+}
+
+func (c *replayConn) LocalAddr() net.Addr {
+	return replayAddr{}
+}
+
+func (c *replayConn) RemoteAddr() net.Addr {
+	return replayAddr{}
+}
+
+// Replayed connections never time out; closing them unblocks reads.
+func (c *replayConn) SetDeadline(t time.Time) error      { return nil }
+func (c *replayConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *replayConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type replayAddr struct{}
+
+func (replayAddr) Network() string { return "replay" }
+func (replayAddr) String() string  { return "replay" }
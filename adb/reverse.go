@@ -0,0 +1,99 @@
+package adb
+
+import (
+	"context"
+	"strings"
+)
+
+// Reverse makes connections to remote on the device reach local on the
+// host, e.g. to let tests talk to a server running on the CI machine. With
+// noRebind an existing reverse of remote is an error. For tcp specs the
+// device port is returned, which is how the port picked for tcp:0 is found
+// out.
+func (d *Device) Reverse(remote, local string, noRebind bool) (int, error) {
+	return d.ReverseContext(context.Background(), remote, local, noRebind)
+}
+
+func (d *Device) ReverseContext(ctx context.Context, remote, local string, noRebind bool) (int, error) {
+	if err := ValidateSpec(remote, true); err != nil {
+		return 0, err
+	}
+	if err := ValidateSpec(local, true); err != nil {
+		return 0, err
+	}
+
+	service := "reverse:forward:"
+	if noRebind {
+		service += "norebind:"
+	}
+	conn, err := dialTransport(ctx, d)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	return conn.forward(service+remote+";"+local, remote)
+}
+
+// ListReverses returns the reverses of this device. Remote is the socket
+// listening on the device and Local the one it reaches on the host.
+func (d *Device) ListReverses() ([]Forward, error) {
+	return d.ListReversesContext(context.Background())
+}
+
+func (d *Device) ListReversesContext(ctx context.Context) ([]Forward, error) {
+	conn, err := dialTransport(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteCmd("reverse:list-forward")
+	if err != nil {
+		return nil, err
+	}
+	list, err := conn.readString()
+	if err != nil {
+		return nil, err
+	}
+
+	var reverses []Forward
+	for _, line := range strings.Split(list, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		reverses = append(reverses, Forward{Serial: d.Serial, Remote: fields[1], Local: fields[2]})
+	}
+	return reverses, nil
+}
+
+// RemoveReverse removes the reverse listening on remote.
+func (d *Device) RemoveReverse(remote string) error {
+	return d.RemoveReverseContext(context.Background(), remote)
+}
+
+func (d *Device) RemoveReverseContext(ctx context.Context, remote string) error {
+	conn, err := dialTransport(ctx, d)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.command("reverse:killforward:" + remote)
+}
+
+// RemoveAllReverses removes every reverse of this device.
+func (d *Device) RemoveAllReverses() error {
+	return d.RemoveAllReversesContext(context.Background())
+}
+
+func (d *Device) RemoveAllReversesContext(ctx context.Context) error {
+	conn, err := dialTransport(ctx, d)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	return conn.command("reverse:killforward-all")
+}
@@ -0,0 +1,200 @@
+package adb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"time"
+)
+
+// serverPollInterval is how often the server port is probed while waiting
+// for the server to start or stop.
+const serverPollInterval = 100 * time.Millisecond
+
+var (
+	ErrAdbNotFound  = errors.New("adb binary not found in PATH, ANDROID_HOME or ANDROID_SDK_ROOT")
+	ErrRemoteServer = errors.New("cannot start an adb server on a remote host")
+
+	binaryVersionRegex = regexp.MustCompile(`Android Debug Bridge version \d+\.\d+\.(\d+)`)
+)
+
+// FindAdb returns the path of the adb binary, looking at PATH first and then
+// at the platform-tools of ANDROID_HOME and ANDROID_SDK_ROOT.
+func FindAdb() (string, error) {
+	name := "adb"
+	if runtime.GOOS == "windows" {
+		name = "adb.exe"
+	}
+
+	path, err := exec.LookPath(name)
+	if err == nil {
+		return path, nil
+	}
+
+	for _, env := range []string{"ANDROID_HOME", "ANDROID_SDK_ROOT"} {
+		sdk := os.Getenv(env)
+		if sdk == "" {
+			continue
+		}
+		path = filepath.Join(sdk, "platform-tools", name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", ErrAdbNotFound
+}
+
+// EnsureServer makes sure an adb server is listening, starting one with the
+// adb binary if nothing answers. A running server whose version differs from
+// the binary's is killed and restarted, as the adb client does.
+func (adb *Adb) EnsureServer() error {
+	return adb.EnsureServerContext(context.Background())
+}
+
+func (adb *Adb) EnsureServerContext(ctx context.Context) error {
+	if !adb.isLocal() {
+		_, err := adb.ServerVersionContext(ctx)
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrRemoteServer, err)
+		}
+		return nil
+	}
+
+	path, err := FindAdb()
+	if err != nil {
+		return err
+	}
+
+	want, err := binaryVersion(ctx, path)
+	if err != nil {
+		return err
+	}
+
+	have, err := adb.ServerVersionContext(ctx)
+	if err == nil && have == want {
+		return nil
+	}
+	if err == nil {
+		err = adb.KillServerContext(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, path, "-P", strconv.Itoa(adb.Port), "start-server")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("adb start-server: %v: %s", err, out)
+	}
+	return adb.waitForServer(ctx, true)
+}
+
+// KillServer asks the adb server to exit and waits until it stops listening.
+func (adb *Adb) KillServer() error {
+	return adb.KillServerContext(context.Background())
+}
+
+func (adb *Adb) KillServerContext(ctx context.Context) error {
+	conn, err := adb.DialContext(ctx)
+	if err != nil {
+		return err
+	}
+	_, err = conn.WriteCmd("host:kill")
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	return adb.waitForServer(ctx, false)
+}
+
+// ServerVersion returns the protocol version of the running adb server, e.g.
+// 41 for the server shipped with platform-tools 1.0.41.
+func (adb *Adb) ServerVersion() (int, error) {
+	return adb.ServerVersionContext(context.Background())
+}
+
+func (adb *Adb) ServerVersionContext(ctx context.Context) (int, error) {
+	version, err := adb.query(ctx, "host:version")
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.ParseInt(version, 16, 0)
+	return int(v), err
+}
+
+// RequireServerVersion fails with a *VersionError when the running server is
+// older than min.
+func (adb *Adb) RequireServerVersion(min int) error {
+	return adb.RequireServerVersionContext(context.Background(), min)
+}
+
+func (adb *Adb) RequireServerVersionContext(ctx context.Context, min int) error {
+	version, err := adb.ServerVersionContext(ctx)
+	if err != nil {
+		return err
+	}
+	if version < min {
+		return &VersionError{Version: version, Required: min}
+	}
+	return nil
+}
+
+// VersionError reports an adb server that is too old.
+type VersionError struct {
+	Version  int
+	Required int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("adb: server version %d is older than required %d", e.Version, e.Required)
+}
+
+// waitForServer polls the server port until it accepts connections, or
+// until it refuses them when up is false.
+func (adb *Adb) waitForServer(ctx context.Context, up bool) error {
+	for {
+		conn, err := adb.DialContext(ctx)
+		if err == nil {
+			conn.Close()
+		}
+		if (err == nil) == up {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(serverPollInterval):
+		}
+	}
+}
+
+func (adb *Adb) isLocal() bool {
+	if adb.Host == "" || adb.Host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(adb.Host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// binaryVersion returns the protocol version of the adb binary at path,
+// which is the last component of "Android Debug Bridge version 1.0.41".
+func binaryVersion(ctx context.Context, path string) (int, error) {
+	out, err := exec.CommandContext(ctx, path, "version").Output()
+	if err != nil {
+		return 0, err
+	}
+
+	match := binaryVersionRegex.FindSubmatch(out)
+	if match == nil {
+		return 0, fmt.Errorf("adb: cannot parse version of %s", path)
+	}
+	return strconv.Atoi(string(match[1]))
+}
@@ -0,0 +1,233 @@
+package adb
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// SessionOptions configures the remote side of a Session.
+type SessionOptions struct {
+	// Pty allocates a terminal on the device. Output of a pty session all
+	// arrives on Stdout.
+	Pty bool
+	// Term is exported as TERM for pty sessions; defaults to "xterm".
+	Term string
+	// Rows and Cols set the initial terminal size when both are non-zero.
+	Rows, Cols int
+}
+
+// Session is an interactive shell v2 session on a device. Data written to
+// Stdin reaches the remote process, whose output can be read from Stdout and
+// Stderr until it exits.
+type Session struct {
+	Stdin  io.WriteCloser
+	Stdout io.Reader
+	Stderr io.Reader
+
+	conn   *AdbConn
+	mu     sync.Mutex
+	stdout *sessionBuffer
+	stderr *sessionBuffer
+	done   chan struct{}
+	code   int
+	err    error
+}
+
+// NewSession starts args on the device, or an interactive shell when no args
+// are given. The session is torn down when ctx is done.
+func NewSession(ctx context.Context, t Transporter, opts *SessionOptions, args ...string) (*Session, error) {
+	if opts == nil {
+		opts = &SessionOptions{}
+	}
+
+	conn, err := dialTransport(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := "raw"
+	if opts.Pty {
+		term := opts.Term
+		if term == "" {
+			term = "xterm"
+		}
+		mode = fmt.Sprintf("TERM=%s,pty", term)
+	}
+	_, err = conn.WriteCmd(fmt.Sprintf("shell,v2,%s:%s", mode, strings.Join(args, " ")))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	s := &Session{
+		conn:   conn,
+		stdout: newSessionBuffer(),
+		stderr: newSessionBuffer(),
+		done:   make(chan struct{}),
+		code:   -1,
+	}
+	s.Stdin = &sessionStdin{s}
+	s.Stdout = s.stdout
+	s.Stderr = s.stderr
+
+	if opts.Rows > 0 && opts.Cols > 0 {
+		err = s.Resize(opts.Rows, opts.Cols)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	go s.demux()
+	return s, nil
+}
+
+func (s *Session) demux() {
+	defer close(s.done)
+	defer s.conn.Close()
+
+	for {
+		id, data, err := readShellPacket(s.conn)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			s.finish(err)
+			return
+		}
+
+		switch id {
+		case shellStdout:
+			s.stdout.write(data)
+		case shellStderr:
+			s.stderr.write(data)
+		case shellExit:
+			if len(data) > 0 {
+				s.code = int(data[0])
+			}
+			s.finish(nil)
+			return
+		}
+	}
+}
+
+func (s *Session) finish(err error) {
+	s.err = err
+	s.stdout.close(err)
+	s.stderr.close(err)
+}
+
+func (s *Session) writePacket(id byte, data []byte) error {
+	return writeShellPacket(&sessionWriter{s}, id, data)
+}
+
+// sessionWriter serialises packet writes from Stdin and Resize.
+type sessionWriter struct {
+	s *Session
+}
+
+func (w *sessionWriter) Write(b []byte) (int, error) {
+	w.s.mu.Lock()
+	defer w.s.mu.Unlock()
+	return w.s.conn.Write(b)
+}
+
+// Resize tells the remote terminal its new size.
+func (s *Session) Resize(rows, cols int) error {
+	size := fmt.Sprintf("%dx%d,%dx%d\x00", rows, cols, 0, 0)
+	return s.writePacket(shellWindowSize, []byte(size))
+}
+
+// Wait blocks until the remote process exits. A non-zero exit status is
+// reported as an *ExitError.
+func (s *Session) Wait() error {
+	<-s.done
+	if s.err != nil {
+		return s.err
+	}
+	if s.code != 0 {
+		return &ExitError{Code: s.code}
+	}
+	return nil
+}
+
+// ExitCode returns the remote exit status, or -1 while the session runs.
+func (s *Session) ExitCode() int {
+	select {
+	case <-s.done:
+		return s.code
+	default:
+		return -1
+	}
+}
+
+// Close ends the session without waiting for the remote process.
+func (s *Session) Close() error {
+	return s.conn.Close()
+}
+
+type sessionStdin struct {
+	s *Session
+}
+
+func (w *sessionStdin) Write(b []byte) (int, error) {
+	out := &shellPacketWriter{w: &sessionWriter{w.s}, id: shellStdin}
+	return out.Write(b)
+}
+
+func (w *sessionStdin) Close() error {
+	return w.s.writePacket(shellCloseStdin, nil)
+}
+
+// sessionBuffer is an unbounded pipe so that a reader ignoring one stream
+// cannot stall the other.
+type sessionBuffer struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	err    error
+	closed bool
+}
+
+func newSessionBuffer() *sessionBuffer {
+	b := &sessionBuffer{}
+	b.cond = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *sessionBuffer) write(data []byte) {
+	b.mu.Lock()
+	b.buf = append(b.buf, data...)
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *sessionBuffer) close(err error) {
+	b.mu.Lock()
+	b.closed = true
+	b.err = err
+	b.mu.Unlock()
+	b.cond.Broadcast()
+}
+
+func (b *sessionBuffer) Read(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for len(b.buf) == 0 && !b.closed {
+		b.cond.Wait()
+	}
+	if len(b.buf) == 0 {
+		if b.err != nil {
+			return 0, b.err
+		}
+		return 0, io.EOF
+	}
+
+	n := copy(p, b.buf)
+	b.buf = b.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,254 @@
+package adb
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Packet ids used by the shell v2 protocol. Every packet is a one byte id
+// followed by a little-endian uint32 length and the payload.
+const (
+	shellStdin       byte = 0
+	shellStdout      byte = 1
+	shellStderr      byte = 2
+	shellExit        byte = 3
+	shellCloseStdin  byte = 4
+	shellWindowSize  byte = 5
+	shellMaxPacket        = 64 * 1024
+	shellHeaderBytes      = 5
+
+	// legacyExitMarker prefixes the exit status echoed after commands run
+	// over the legacy shell service, which has no exit packet.
+	legacyExitMarker = ":ADB_EXIT:"
+)
+
+// ShellV2 starts a raw (non-pty) shell v2 session running args.
+func (a *AdbConn) ShellV2(args ...string) error {
+	cmd := fmt.Sprintf("shell,v2,raw:%s", strings.Join(args, " "))
+	_, err := a.WriteCmd(cmd)
+	return err
+}
+
+func readShellPacket(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, shellHeaderBytes)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	data := make([]byte, binary.LittleEndian.Uint32(header[1:]))
+	_, err = io.ReadFull(r, data)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return header[0], data, err
+}
+
+func writeShellPacket(w io.Writer, id byte, data []byte) error {
+	packet := make([]byte, shellHeaderBytes+len(data))
+	packet[0] = id
+	binary.LittleEndian.PutUint32(packet[1:], uint32(len(data)))
+	copy(packet[shellHeaderBytes:], data)
+	_, err := w.Write(packet)
+	return err
+}
+
+// shellPacketWriter wraps everything written to it in packets of one id.
+type shellPacketWriter struct {
+	w  io.Writer
+	id byte
+}
+
+func (s *shellPacketWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		n := len(b)
+		if n > shellMaxPacket {
+			n = shellMaxPacket
+		}
+		err := writeShellPacket(s.w, s.id, b[:n])
+		if err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// ExitError is returned by ShellCommand when the remote command exits with a
+// non-zero status.
+type ExitError struct {
+	Code int
+	// Stderr holds the command's error output when ShellCommand.Output
+	// collected it.
+	Stderr []byte
+}
+
+func (e *ExitError) Error() string {
+	return fmt.Sprintf("adb: remote command exited with status %d", e.Code)
+}
+
+// ShellCommand runs a command on a device over the shell v2 protocol, which
+// keeps stdout and stderr apart and reports the remote exit code.
+type ShellCommand struct {
+	Transporter Transporter
+	Args        []string
+
+	// Stdin is copied to the remote command, which sees end of input once it
+	// is exhausted. A nil Stdin closes the remote input immediately.
+	Stdin  io.Reader
+	Stdout io.Writer
+	Stderr io.Writer
+
+	// ExitCode is the remote exit status, or -1 until Run completes.
+	ExitCode int
+}
+
+func Command(t Transporter, args ...string) *ShellCommand {
+	return &ShellCommand{Transporter: t, Args: args, ExitCode: -1}
+}
+
+func (c *ShellCommand) Run() error {
+	return c.RunContext(context.Background())
+}
+
+// RunContext runs the command and waits for it to exit. A non-zero exit
+// status is reported as an *ExitError. Devices without the shell_v2 feature
+// fall back to the legacy shell service, where stderr is merged into Stdout
+// and Stdin is ignored.
+func (c *ShellCommand) RunContext(ctx context.Context) error {
+	c.ExitCode = -1
+
+	v2, err := hasFeature(ctx, c.Transporter, FeatureShellV2)
+	if err != nil {
+		return err
+	} else if !v2 {
+		return c.runLegacy(ctx)
+	}
+
+	conn, err := dialTransport(ctx, c.Transporter)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = conn.ShellV2(c.Args...)
+	if err != nil {
+		return err
+	}
+
+	if c.Stdin != nil {
+		go func() {
+			io.Copy(&shellPacketWriter{conn, shellStdin}, c.Stdin)
+			writeShellPacket(conn, shellCloseStdin, nil)
+		}()
+	} else {
+		err = writeShellPacket(conn, shellCloseStdin, nil)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		id, data, err := readShellPacket(conn)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+
+		switch id {
+		case shellStdout:
+			if c.Stdout != nil {
+				c.Stdout.Write(data)
+			}
+		case shellStderr:
+			if c.Stderr != nil {
+				c.Stderr.Write(data)
+			}
+		case shellExit:
+			if len(data) > 0 {
+				c.ExitCode = int(data[0])
+			}
+			if c.ExitCode != 0 {
+				return &ExitError{Code: c.ExitCode}
+			}
+			return nil
+		}
+	}
+}
+
+func (c *ShellCommand) runLegacy(ctx context.Context) error {
+	conn, err := dialTransport(ctx, c.Transporter)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	args := append(c.Args[:len(c.Args):len(c.Args)], ";", "echo", legacyExitMarker+"$?")
+	err = conn.Shell(args...)
+	if err != nil {
+		return err
+	}
+
+	for {
+		line, err := conn.r.ReadBytes('\n')
+		line = bytes.Replace(line, []byte("\r\n"), []byte("\n"), -1)
+		// Output without a trailing newline shares its last line with the
+		// marker.
+		if i := bytes.LastIndex(line, []byte(legacyExitMarker)); i >= 0 {
+			if c.Stdout != nil && i > 0 {
+				c.Stdout.Write(line[:i])
+			}
+			code := bytes.TrimSpace(line[i+len(legacyExitMarker):])
+			fmt.Sscanf(string(code), "%d", &c.ExitCode)
+			if c.ExitCode != 0 {
+				return &ExitError{Code: c.ExitCode}
+			}
+			return nil
+		}
+		if c.Stdout != nil {
+			c.Stdout.Write(line)
+		}
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+	}
+}
+
+// Output runs the command and returns its standard output. When Stderr is
+// not set, the error output is collected into the returned *ExitError.
+func (c *ShellCommand) Output() ([]byte, error) {
+	return c.OutputContext(context.Background())
+}
+
+func (c *ShellCommand) OutputContext(ctx context.Context) ([]byte, error) {
+	var stdout, stderr bytes.Buffer
+	c.Stdout = &stdout
+	captureErr := c.Stderr == nil
+	if captureErr {
+		c.Stderr = &stderr
+	}
+
+	err := c.RunContext(ctx)
+	if ee, ok := err.(*ExitError); ok && captureErr {
+		ee.Stderr = stderr.Bytes()
+	}
+	return stdout.Bytes(), err
+}
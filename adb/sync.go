@@ -2,11 +2,11 @@ package adb
 
 import (
 	"bufio"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"os"
 )
 
@@ -16,26 +16,30 @@ func readUInt32(a *AdbConn) uint32 {
 	return binary.LittleEndian.Uint32(b)
 }
 
-func parseDent(a *AdbConn) {
+func parseDent(a *AdbConn) ([]byte, error) {
 	readUInt32(a)           // MODE
 	readUInt32(a)           // SIZE
 	readUInt32(a)           // MODIFIED TIME
 	length := readUInt32(a) // NAME LENGTH
 
 	b := make([]byte, length)
-	a.Read(b)
-
-	log.Printf("%s\n", b)
+	_, err := io.ReadFull(a, b)
+	return b, err
 }
 
+// Ls returns the names in the remote directory, one per line.
 func Ls(t Transporter, remote string) ([]byte, error) {
-	conn, err := t.Dial()
+	return LsContext(context.Background(), t, remote)
+}
+
+// LsContext is like Ls but aborts the listing once ctx is done.
+func LsContext(ctx context.Context, t Transporter, remote string) ([]byte, error) {
+	conn, err := dialTransport(ctx, t)
 	if err != nil {
-		return []byte{}, err
+		return nil, err
 	}
 	defer conn.Close()
 
-	t.Transport(conn)
 	_, err = conn.WriteCmd("sync:")
 	if err != nil {
 		return nil, err
@@ -45,20 +49,35 @@ func Ls(t Transporter, remote string) ([]byte, error) {
 	w.WriteString("LIST")
 	binary.Write(w, binary.LittleEndian, uint32(len(remote)))
 	w.WriteString(remote)
-	w.Flush()
+	err = w.Flush()
+	if err != nil {
+		return nil, err
+	}
 
-	b := make([]byte, 4)
+	var names []byte
 	for {
-		conn.Read(b)
-		id := string(b)
-		if id == "DENT" {
-			parseDent(conn)
+		id, err := conn.ReadCode()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if id == "FAIL" {
+			return nil, conn.readSyncFail("LIST " + remote)
+		} else if id == "DENT" {
+			name, err := parseDent(conn)
+			if err != nil {
+				return nil, err
+			}
+			names = append(names, name...)
+			names = append(names, '\n')
 		} else if id == "DONE" {
 			break
 		}
 	}
 
-	return b, nil
+	return names, nil
 }
 
 func PushToDevices(devices []*Device, local io.Reader, mode os.FileMode, modtime uint32, remote string) error {
@@ -71,20 +90,42 @@ func PushToDevices(devices []*Device, local io.Reader, mode os.FileMode, modtime
 }
 
 func Push(devices []Transporter, local io.Reader, mode os.FileMode, modtime uint32, remote string) error {
-	d := make([]io.Writer, 0, len(devices))
+	return PushContext(context.Background(), devices, local, mode, modtime, remote)
+}
+
+// PushContext is like Push but aborts the transfer to every device once ctx
+// is done. A device that fails does not stop the push to the others; the
+// failures are joined in the returned error.
+func PushContext(ctx context.Context, devices []Transporter, local io.Reader, mode os.FileMode, modtime uint32, remote string) error {
+	var errs []error
+	targets := make([]*pushTarget, 0, len(devices))
+	defer func() {
+		for _, t := range targets {
+			t.conn.Close()
+		}
+	}()
+
 	for _, t := range devices {
-		conn, err := GetPushWriter(t, remote, uint32(mode))
+		conn, err := getPushWriter(ctx, t, remote, uint32(mode))
 		if err != nil {
-			return err
+			errs = append(errs, err)
+			continue
 		}
-		d = append(d, io.Writer(conn))
-		defer conn.VerifyOk()
+		targets = append(targets, &pushTarget{conn: conn})
+	}
+
+	d := make([]io.Writer, 0, len(targets))
+	for _, t := range targets {
+		d = append(d, io.Writer(t))
 	}
 
 	reader := bufio.NewReader(local)
 	sections := NewSectionedMultiWriter(d...)
 	writer := bufio.NewWriter(sections)
-	writer.ReadFrom(reader)
+	_, err := writer.ReadFrom(reader)
+	if err != nil {
+		return err
+	}
 	writer.Flush()
 	sections.Close()
 
@@ -93,16 +134,47 @@ func Push(devices []Transporter, local io.Reader, mode os.FileMode, modtime uint
 	binary.Write(wr, binary.LittleEndian, modtime)
 	wr.Flush()
 
-	return nil
+	for _, t := range targets {
+		if t.err != nil {
+			errs = append(errs, t.err)
+			continue
+		}
+		err := t.conn.verifySyncOk("SEND " + remote)
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		return errors.Join(errs...)
+	}
+	return ctx.Err()
+}
+
+// pushTarget is one device of a multi-device push. Once a write to it fails
+// it drops the rest of the data, so the other devices keep receiving.
+type pushTarget struct {
+	conn *AdbConn
+	err  error
+}
+
+func (t *pushTarget) Write(b []byte) (int, error) {
+	if t.err == nil {
+		_, t.err = t.conn.Write(b)
+	}
+	return len(b), nil
 }
 
 func PushFile(t []Transporter, local *os.File, remote string) error {
+	return PushFileContext(context.Background(), t, local, remote)
+}
+
+func PushFileContext(ctx context.Context, t []Transporter, local *os.File, remote string) error {
 	info, err := local.Stat()
 	if err != nil {
 		return err
 	}
 
-	return Push(t, local, info.Mode(), uint32(info.ModTime().Unix()), remote)
+	return PushContext(ctx, t, local, info.Mode(), uint32(info.ModTime().Unix()), remote)
 }
 
 func PushFileToDevices(devices []*Device, local *os.File, remote string) error {
@@ -119,35 +191,83 @@ func PushFileTo(t Transporter, local *os.File, remote string) error {
 }
 
 func GetPushWriter(t Transporter, remote string, filePerm uint32) (*AdbConn, error) {
-	conn, err := t.Dial()
+	return getPushWriter(context.Background(), t, remote, filePerm)
+}
+
+func getPushWriter(ctx context.Context, t Transporter, remote string, filePerm uint32) (*AdbConn, error) {
+	conn, err := dialTransport(ctx, t)
 	if err != nil {
 		return nil, err
 	}
 
-	t.Transport(conn)
 	_, err = conn.WriteCmd("sync:")
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
+	// The mode follows the path as a decimal string, as in "/sdcard/a,420".
+	header := fmt.Sprintf("%s,%d", remote, filePerm)
 	w := bufio.NewWriter(conn)
 	w.WriteString("SEND")
-	binary.Write(w, binary.LittleEndian, uint32(len(remote)+5))
-	w.WriteString(remote)
-	w.WriteString(",")
-	binary.Write(w, binary.LittleEndian, filePerm)
+	binary.Write(w, binary.LittleEndian, uint32(len(header)))
+	w.WriteString(header)
 	w.Flush()
 
 	return conn, nil
 }
 
+// pushWriter streams a single file to one device over sync SEND. The
+// transfer completes when it is closed, giving the file modtime.
+type pushWriter struct {
+	conn     *AdbConn
+	sections *SectionedMultiWriter
+	remote   string
+	modtime  uint32
+}
+
+func newPushWriter(ctx context.Context, t Transporter, remote string, filePerm uint32, modtime uint32) (*pushWriter, error) {
+	conn, err := getPushWriter(ctx, t, remote, filePerm)
+	if err != nil {
+		return nil, err
+	}
+	return &pushWriter{conn: conn, sections: NewSectionedMultiWriter(conn), remote: remote, modtime: modtime}, nil
+}
+
+func (w *pushWriter) Write(b []byte) (int, error) {
+	return w.sections.Write(b)
+}
+
+func (w *pushWriter) Close() error {
+	defer w.conn.Close()
+
+	err := w.sections.Close()
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(w.conn)
+	wr.WriteString("DONE")
+	binary.Write(wr, binary.LittleEndian, w.modtime)
+	err = wr.Flush()
+	if err != nil {
+		return err
+	}
+	return w.conn.verifySyncOk("SEND " + w.remote)
+}
+
 func Pull(t Transporter, local io.Writer, remote string) error {
-	conn, err := t.Dial()
+	return PullContext(context.Background(), t, local, remote)
+}
+
+// PullContext is like Pull but aborts the transfer once ctx is done.
+func PullContext(ctx context.Context, t Transporter, local io.Writer, remote string) error {
+	conn, err := dialTransport(ctx, t)
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	t.Transport(conn)
 	_, err = conn.WriteCmd("sync:")
 	if err != nil {
 		return err
@@ -157,25 +277,79 @@ func Pull(t Transporter, local io.Writer, remote string) error {
 	w.WriteString("RECV")
 	binary.Write(w, binary.LittleEndian, uint32(len(remote)))
 	w.WriteString(remote)
-	w.Flush()
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
 
 	writer := bufio.NewWriter(local)
 	code, err := conn.ReadCode()
 
-	if code == `FAIL` {
-		return errors.New(fmt.Sprintf("Unable to locate file %s", remote))
-	}
-
 	var n uint32
 	for err == nil && code != `DONE` {
-		binary.Read(conn, binary.LittleEndian, &n)
-		writer.ReadFrom(&io.LimitedReader{conn, int64(n)})
-		writer.Flush()
+		if code == `FAIL` {
+			return conn.readSyncFail("RECV " + remote)
+		}
+
+		err = binary.Read(conn, binary.LittleEndian, &n)
+		if err != nil {
+			break
+		}
+		var written int64
+		written, err = writer.ReadFrom(&io.LimitedReader{R: conn, N: int64(n)})
+		if err == nil && written < int64(n) {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			break
+		}
+		err = writer.Flush()
+		if err != nil {
+			return err
+		}
 
 		code, err = conn.ReadCode()
 	}
 
-	return nil
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// verifySyncOk reads the status that ends a sync request. Unlike host
+// requests, the sync protocol prefixes its FAIL reason with a little-endian
+// length.
+func (a *AdbConn) verifySyncOk(request string) error {
+	code, err := a.ReadCode()
+	if err != nil {
+		return err
+	}
+
+	switch code {
+	case `OKAY`:
+		var n uint32
+		return binary.Read(a, binary.LittleEndian, &n)
+	case `FAIL`:
+		return a.readSyncFail(request)
+	}
+	return errors.New(`Invalid sync CODE: ` + code)
+}
+
+// readSyncFail reads the reason following a sync FAIL status.
+func (a *AdbConn) readSyncFail(request string) error {
+	var n uint32
+	err := binary.Read(a, binary.LittleEndian, &n)
+	if err != nil {
+		return err
+	}
+
+	msg := make([]byte, n)
+	_, err = io.ReadFull(a, msg)
+	if err != nil {
+		return err
+	}
+	return &ServerError{Request: request, Message: string(msg)}
 }
 
 type SectionedMultiWriter struct {
@@ -189,35 +363,39 @@ func NewSectionedMultiWriter(writers ...io.Writer) *SectionedMultiWriter {
 	return &SectionedMultiWriter{writer: io.MultiWriter(writers...), buffer: make([]byte, 65536)}
 }
 
+// Write buffers b and sends a DATA section whenever the buffer fills up.
 func (w *SectionedMultiWriter) Write(b []byte) (int, error) {
-	i := copy(w.buffer[w.bufferIdx:], b)
-	w.bufferIdx += i
-
-	atmax := w.bufferIdx == 65536
-	if i < len(b) || atmax {
-		w.section++
-		w.Flush()
-
-		if !atmax {
-			return w.Write(b[i:])
+	written := 0
+	for len(b) > 0 {
+		i := copy(w.buffer[w.bufferIdx:], b)
+		w.bufferIdx += i
+		written += i
+		b = b[i:]
+
+		if w.bufferIdx == len(w.buffer) {
+			w.section++
+			err := w.Flush()
+			if err != nil {
+				return written, err
+			}
 		}
 	}
-	return i, nil
+	return written, nil
 }
 
-func (w *SectionedMultiWriter) Flush() {
+func (w *SectionedMultiWriter) Flush() error {
 	wr := bufio.NewWriter(w.writer)
 	wr.WriteString("DATA")
 	binary.Write(wr, binary.LittleEndian, uint32(w.bufferIdx))
 	wr.Write(w.buffer[:w.bufferIdx])
-	wr.Flush()
-
 	w.bufferIdx = 0
+
+	return wr.Flush()
 }
 
 func (w *SectionedMultiWriter) Close() error {
-	if len(w.buffer) != 0 {
-		w.Flush()
+	if w.bufferIdx != 0 {
+		return w.Flush()
 	}
 	return nil
 }
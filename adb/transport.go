@@ -0,0 +1,70 @@
+package adb
+
+import "fmt"
+
+// HostPrefixer is implemented by Transporters that can also address their
+// device in host requests, e.g. "host-serial:<serial>" as used in
+// "host-serial:<serial>:features".
+type HostPrefixer interface {
+	HostPrefix() string
+}
+
+// hostRequest prefixes service with the host prefix of t.
+func hostRequest(t HostPrefixer, service string) string {
+	return t.HostPrefix() + ":" + service
+}
+
+// SerialTransport reaches the device with the given serial.
+type SerialTransport struct {
+	Dialer
+	Serial string
+}
+
+func (t *SerialTransport) Transport(conn *AdbConn) error {
+	return conn.TransportSerial(t.Serial)
+}
+
+func (t *SerialTransport) HostPrefix() string {
+	return "host-serial:" + t.Serial
+}
+
+// IDTransport reaches a device by the transport id assigned by the server,
+// which stays unique even when devices report the same serial.
+type IDTransport struct {
+	Dialer
+	ID int64
+}
+
+func (t *IDTransport) Transport(conn *AdbConn) error {
+	return conn.TransportID(t.ID)
+}
+
+func (t *IDTransport) HostPrefix() string {
+	return fmt.Sprintf("host-transport-id:%d", t.ID)
+}
+
+// UsbTransport reaches the only device connected over USB.
+type UsbTransport struct {
+	Dialer
+}
+
+func (t *UsbTransport) Transport(conn *AdbConn) error {
+	return conn.TransportUsb()
+}
+
+func (t *UsbTransport) HostPrefix() string {
+	return "host-usb"
+}
+
+// LocalTransport reaches the only emulator or TCP device.
+type LocalTransport struct {
+	Dialer
+}
+
+func (t *LocalTransport) Transport(conn *AdbConn) error {
+	return conn.TransportEmulator()
+}
+
+func (t *LocalTransport) HostPrefix() string {
+	return "host-local"
+}
@@ -0,0 +1,112 @@
+package adb
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+)
+
+// DialService opens a stream to service on the device behind t, such as
+// "tcp:8080" or "localabstract:chrome_devtools_remote". The stream uses its
+// own adb connection, so nothing is left registered on the server. As with
+// net.Dialer, ctx only bounds connecting.
+func DialService(ctx context.Context, t Transporter, service string) (net.Conn, error) {
+	conn, err := dialTransport(ctx, t)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.WriteCmd(service)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.unbind()
+	return conn, nil
+}
+
+func (d *Device) DialService(ctx context.Context, service string) (net.Conn, error) {
+	return DialService(ctx, d, service)
+}
+
+// ListenAndForward listens on the local TCP address and pipes every
+// connection it accepts to remoteSpec on the device behind t, each through
+// its own adb connection. It only returns on error.
+func ListenAndForward(localAddr string, t Transporter, remoteSpec string) error {
+	return ListenAndForwardContext(context.Background(), localAddr, t, remoteSpec)
+}
+
+// ListenAndForwardContext is like ListenAndForward but stops listening and
+// closes every forwarded connection once ctx is done.
+func ListenAndForwardContext(ctx context.Context, localAddr string, t Transporter, remoteSpec string) error {
+	if err := ValidateSpec(remoteSpec, false); err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", localAddr)
+	if err != nil {
+		return err
+	}
+	return ServeForward(ctx, l, t, remoteSpec)
+}
+
+// ServeForward accepts connections on l and pipes each to remoteSpec on the
+// device behind t until ctx is done or l fails. l is closed on return.
+func ServeForward(ctx context.Context, l net.Listener, t Transporter, remoteSpec string) error {
+	stop := context.AfterFunc(ctx, func() {
+		l.Close()
+	})
+	defer stop()
+	defer l.Close()
+
+	for {
+		local, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+
+		go func() {
+			defer local.Close()
+
+			remote, err := DialService(ctx, t, remoteSpec)
+			if err != nil {
+				return
+			}
+			defer remote.Close()
+
+			pipe(ctx, local, remote)
+		}()
+	}
+}
+
+// pipe copies between a and b until either side is done or ctx is.
+func pipe(ctx context.Context, a, b net.Conn) {
+	var once sync.Once
+	closeBoth := func() {
+		once.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	stop := context.AfterFunc(ctx, closeBoth)
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(a, b)
+		closeBoth()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(b, a)
+		closeBoth()
+	}()
+	wg.Wait()
+}
@@ -0,0 +1,183 @@
+package adb
+
+import (
+	"context"
+	"time"
+)
+
+// reconnectInterval is how long a DeviceWatcher waits before reconnecting to
+// an adb server that went away.
+const reconnectInterval = time.Second
+
+type DeviceEventType int
+
+const (
+	Connected DeviceEventType = iota
+	Disconnected
+	StateChanged
+)
+
+var eventMap = map[DeviceEventType]string{
+	Connected:    `Connected`,
+	Disconnected: `Disconnected`,
+	StateChanged: `StateChanged`,
+}
+
+func (t DeviceEventType) String() string {
+	return eventMap[t]
+}
+
+// DeviceEvent describes a change in the server's device list. Device is the
+// same value for every event of a device until it disconnects; its
+// properties are not loaded, call Update for that. Devices are told apart by
+// transport id, so two devices reporting the same serial each get their own
+// events.
+type DeviceEvent struct {
+	Type     DeviceEventType
+	Device   *Device
+	Info     DeviceInfo
+	OldState DeviceState
+}
+
+// DeviceWatcher reports devices as they come and go. It follows
+// host:track-devices-l and reconnects when the adb server restarts, in which
+// case every known device is first reported as disconnected.
+type DeviceWatcher struct {
+	Events <-chan DeviceEvent
+
+	adb     *Adb
+	events  chan DeviceEvent
+	cancel  context.CancelFunc
+	known   map[watchKey]DeviceInfo
+	devices map[watchKey]*Device
+}
+
+// watchKey identifies a device in the list: by transport id when the server
+// reports one, by serial otherwise.
+type watchKey struct {
+	serial string
+	id     int64
+}
+
+func keyOf(info DeviceInfo) watchKey {
+	if info.TransportID != 0 {
+		return watchKey{id: info.TransportID}
+	}
+	return watchKey{serial: info.Serial}
+}
+
+// WatchDevices starts a DeviceWatcher that runs until ctx is done or the
+// watcher is closed.
+func (adb *Adb) WatchDevices(ctx context.Context) *DeviceWatcher {
+	ctx, cancel := context.WithCancel(ctx)
+	events := make(chan DeviceEvent)
+	w := &DeviceWatcher{
+		Events:  events,
+		adb:     adb,
+		events:  events,
+		cancel:  cancel,
+		known:   make(map[watchKey]DeviceInfo),
+		devices: make(map[watchKey]*Device),
+	}
+	go w.run(ctx)
+	return w
+}
+
+// Close stops the watcher and closes Events.
+func (w *DeviceWatcher) Close() {
+	w.cancel()
+}
+
+func (w *DeviceWatcher) run(ctx context.Context) {
+	defer close(w.events)
+
+	for {
+		w.track(ctx)
+		if !w.update(ctx, nil) {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(reconnectInterval):
+		}
+	}
+}
+
+// track follows the server's device list until the connection drops.
+func (w *DeviceWatcher) track(ctx context.Context) {
+	conn, err := w.adb.DialContext(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	_, err = conn.WriteCmd("host:track-devices-l")
+	if err != nil {
+		return
+	}
+
+	for {
+		list, err := conn.readString()
+		if err != nil {
+			return
+		}
+		if !w.update(ctx, parseDeviceList(list)) {
+			return
+		}
+	}
+}
+
+// update diffs infos against the last snapshot and sends the resulting
+// events. It returns false once ctx is done.
+func (w *DeviceWatcher) update(ctx context.Context, infos []DeviceInfo) bool {
+	current := make(map[watchKey]DeviceInfo, len(infos))
+	for _, info := range infos {
+		current[keyOf(info)] = info
+	}
+
+	// Disconnects go first, so a device that came back under a new
+	// transport id is reported gone before it is reported connected.
+	for key, old := range w.known {
+		if _, ok := current[key]; ok {
+			continue
+		}
+		d := w.devices[key]
+		delete(w.devices, key)
+		if !w.send(ctx, DeviceEvent{Type: Disconnected, Device: d, Info: old, OldState: old.State}) {
+			return false
+		}
+	}
+
+	for _, info := range infos {
+		key := keyOf(info)
+		old, ok := w.known[key]
+		if !ok {
+			d := &Device{Dialer: w.adb.Dialer, Serial: info.Serial, TransportID: info.TransportID}
+			w.devices[key] = d
+			if !w.send(ctx, DeviceEvent{Type: Connected, Device: d, Info: info}) {
+				return false
+			}
+		} else if old.State != info.State {
+			d := w.devices[key]
+			d.TransportID = info.TransportID
+			event := DeviceEvent{Type: StateChanged, Device: d, Info: info, OldState: old.State}
+			if !w.send(ctx, event) {
+				return false
+			}
+		}
+	}
+
+	w.known = current
+	return true
+}
+
+func (w *DeviceWatcher) send(ctx context.Context, event DeviceEvent) bool {
+	select {
+	case w.events <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
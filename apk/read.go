@@ -0,0 +1,41 @@
+package apk
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+)
+
+var ErrNoManifest = errors.New("apk: AndroidManifest.xml not found")
+
+// ReadManifest decodes the AndroidManifest.xml of the APK file.
+func ReadManifest(filename string) (*Manifest, error) {
+	r, err := zip.OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	for _, f := range r.File {
+		if f.Name != "AndroidManifest.xml" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		data, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		var manifest Manifest
+		err = Unmarshal(data, &manifest)
+		if err != nil {
+			return nil, err
+		}
+		return &manifest, nil
+	}
+	return nil, ErrNoManifest
+}
@@ -0,0 +1,40 @@
+// Command devicelab serves the devices of an adb server over HTTP, so they
+// can be used from machines without access to the lab.
+//
+//	GET  /devices?filter=type=tablet;sdk>=26   list devices
+//	GET  /devices/{serial}                     describe a device
+//	GET  /devices/{serial}/props               system properties
+//	POST /devices/{serial}/shell               run {"args": [...]}, streamed
+//	GET  /devices/{serial}/files/{path...}     pull a file
+//	PUT  /devices/{serial}/files/{path...}     push a file, ?mode=0644
+//	POST /devices/{serial}/install             install the APK in the body
+//	GET  /devices/{serial}/screenshot          PNG screenshot
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/wmbest2/android/adb"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "address to serve HTTP on")
+	server := flag.String("adb", "localhost:5037", "address of the adb server")
+	flag.Parse()
+
+	host, portStr, err := net.SplitHostPort(*server)
+	if err != nil {
+		log.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	log.Printf("serving %s on %s", *server, *listen)
+	log.Fatal(http.ListenAndServe(*listen, newServer(adb.Connect(host, port))))
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+)
+
+// Trailers of a streamed shell command: its exit status, and why it could
+// not be run to completion.
+const (
+	exitCodeTrailer = "Adb-Exit-Code"
+	errorTrailer    = "Adb-Error"
+)
+
+type server struct {
+	adb    *adb.Adb
+	routes map[string]map[string]deviceHandler
+}
+
+type deviceHandler func(w http.ResponseWriter, r *http.Request, d *adb.Device)
+
+// newServer returns the HTTP API for the devices of a. Pointing a at a fake
+// adb server makes it testable without devices.
+func newServer(a *adb.Adb) http.Handler {
+	s := &server{adb: a}
+
+	// Routes under /devices/{serial}, by endpoint and method. They are
+	// matched by hand since method and wildcard patterns need a module
+	// declaring Go 1.22.
+	s.routes = map[string]map[string]deviceHandler{
+		"":           {"GET": s.getDevice},
+		"props":      {"GET": s.getProps},
+		"shell":      {"POST": s.shell},
+		"files":      {"GET": s.pull, "PUT": s.push},
+		"install":    {"POST": s.install},
+		"screenshot": {"GET": s.screenshot},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/devices", s.listDevices)
+	mux.HandleFunc("/devices/", s.device)
+	return mux
+}
+
+// device serves /devices/{serial}[/{endpoint}[/{path}]]. Only the device
+// named is queried, so requests do not shell into the whole lab.
+func (s *server) device(w http.ResponseWriter, r *http.Request) {
+	serial, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/devices/"), "/")
+	endpoint, path, _ := strings.Cut(rest, "/")
+
+	methods, ok := s.routes[endpoint]
+	if !ok || serial == "" || (path != "") != (endpoint == "files") {
+		http.NotFound(w, r)
+		return
+	}
+	h, ok := methods[r.Method]
+	if !ok {
+		allow := make([]string, 0, len(methods))
+		for m := range methods {
+			allow = append(allow, m)
+		}
+		sort.Strings(allow)
+		methodNotAllowed(w, allow...)
+		return
+	}
+
+	d, err := s.adb.FindDeviceContext(r.Context(), serial)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	h(w, r, &d)
+}
+
+// methodNotAllowed answers a request for a method the endpoint does not
+// have.
+func methodNotAllowed(w http.ResponseWriter, allow ...string) {
+	w.Header().Set("Allow", strings.Join(allow, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, errorResponse{Error: "method not allowed"})
+}
+
+// remotePath returns the device path of a /devices/{serial}/files/{path}
+// request.
+func remotePath(r *http.Request) string {
+	rest := strings.TrimPrefix(r.URL.Path, "/devices/")
+	_, rest, _ = strings.Cut(rest, "/")
+	return "/" + strings.TrimPrefix(rest, "files/")
+}
+
+func (s *server) listDevices(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		methodNotAllowed(w, "GET")
+		return
+	}
+	filter, err := adb.ParseDeviceFilter(r.URL.Query().Get("filter"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	devices, err := s.adb.ListDevicesContext(r.Context(), filter)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, devices)
+}
+
+func (s *server) getDevice(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	writeJSON(w, http.StatusOK, d)
+}
+
+func (s *server) getProps(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	writeJSON(w, http.StatusOK, d.Properties)
+}
+
+type shellRequest struct {
+	Args []string `json:"args"`
+}
+
+// shell streams the command's stdout and stderr as a chunked text response
+// and reports its exit status in the Adb-Exit-Code trailer. A failure to run
+// it, such as a lost transport, is reported in the Adb-Error trailer.
+func (s *server) shell(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	var req shellRequest
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil || len(req.Args) == 0 {
+		writeJSON(w, http.StatusBadRequest, errorResponse{Error: "expected {\"args\": [...]}"})
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", exitCodeTrailer+", "+errorTrailer)
+	w.WriteHeader(http.StatusOK)
+
+	out := &flushWriter{w: w}
+	out.flusher, _ = w.(http.Flusher)
+
+	cmd := adb.Command(d, req.Args...)
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.RunContext(r.Context())
+	w.Header().Set(exitCodeTrailer, strconv.Itoa(cmd.ExitCode))
+	var exitErr *adb.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		w.Header().Set(errorTrailer, err.Error())
+	}
+}
+
+// pull streams the file. Errors can only be reported before the first byte
+// is sent; after that the response is aborted so the client sees it is
+// truncated.
+func (s *server) pull(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	out := &countingWriter{w: w}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	err := adb.PullContext(r.Context(), d, out, remotePath(r))
+	if err == nil {
+		return
+	}
+	if out.n > 0 {
+		panic(http.ErrAbortHandler)
+	}
+	writeError(w, err)
+}
+
+func (s *server) push(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	mode := os.FileMode(0644)
+	if m := r.URL.Query().Get("mode"); m != "" {
+		n, err := strconv.ParseUint(m, 8, 32)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, errorResponse{Error: "invalid mode " + m})
+			return
+		}
+		mode = os.FileMode(n)
+	}
+
+	remote := remotePath(r)
+	err := adb.PushContext(r.Context(), []adb.Transporter{d}, r.Body, mode, uint32(time.Now().Unix()), remote)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// install saves the uploaded APK to a temporary file and installs it. The
+// replace, downgrade, grant and test query parameters set the matching
+// install options.
+func (s *server) install(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	f, err := os.CreateTemp("", "devicelab-*.apk")
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	_, err = io.Copy(f, r.Body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	q := r.URL.Query()
+	opts := &adb.InstallOptions{
+		Replace:          q.Has("replace"),
+		Downgrade:        q.Has("downgrade"),
+		GrantPermissions: q.Has("grant"),
+		TestOnly:         q.Has("test"),
+	}
+	result, err := d.InstallContext(r.Context(), f.Name(), opts)
+	if result != nil {
+		status := http.StatusOK
+		if !result.Success {
+			status = http.StatusUnprocessableEntity
+		}
+		writeJSON(w, status, result)
+		return
+	}
+	writeError(w, err)
+}
+
+func (s *server) screenshot(w http.ResponseWriter, r *http.Request, d *adb.Device) {
+	png, err := adb.ScreencapContext(r.Context(), d)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(png)
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// writeError maps adb errors to HTTP statuses.
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, adb.ErrDeviceNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, adb.ErrInvalidFilter):
+		status = http.StatusBadRequest
+	case errors.Is(err, adb.ErrDeviceOffline), errors.Is(err, adb.ErrUnauthorized):
+		status = http.StatusConflict
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// flushWriter sends every write to the client straight away.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(b []byte) (int, error) {
+	n, err := f.w.Write(b)
+	if f.flusher != nil {
+		f.flusher.Flush()
+	}
+	return n, err
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
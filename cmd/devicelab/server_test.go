@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+// newTestServer serves a fake adb server with one online device.
+func newTestServer(t *testing.T) (*httptest.Server, *adbtest.Server, *adbtest.Device) {
+	t.Helper()
+
+	fake, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { fake.Close() })
+	d := fake.AddDevice("emulator-5554")
+
+	ts := httptest.NewServer(newServer(fake.Adb()))
+	t.Cleanup(ts.Close)
+	return ts, fake, d
+}
+
+func do(t *testing.T, method, url string, body io.Reader) (*http.Response, []byte) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+func TestListDevices(t *testing.T) {
+	ts, fake, _ := newTestServer(t)
+	tablet := fake.AddDevice("emulator-5556")
+	tablet.SetProp("ro.sf.lcd_density", "160")
+	tablet.SetScreenSize(800, 1280)
+	tablet.SetProp("ro.build.version.sdk", "30")
+	fake.AddDevice("offline").SetState(adb.StateOffline)
+
+	tests := []struct {
+		filter  string
+		status  int
+		serials []string
+	}{
+		{"", http.StatusOK, []string{"emulator-5554", "emulator-5556"}},
+		{"sdk=30", http.StatusOK, []string{"emulator-5556"}},
+		{"type=tablet", http.StatusOK, []string{"emulator-5556"}},
+		{"type=tablet10", http.StatusOK, []string{"emulator-5556"}},
+		{"type=tablet7", http.StatusOK, []string{}},
+		{"type=phone", http.StatusOK, []string{"emulator-5554"}},
+		{"type=watch", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter, func(t *testing.T) {
+			resp, body := do(t, "GET", ts.URL+"/devices?filter="+url.QueryEscape(tt.filter), nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.serials == nil {
+				return
+			}
+
+			var devices []struct {
+				Serial string `json:"serial"`
+			}
+			err := json.Unmarshal(body, &devices)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serials := []string{}
+			for _, d := range devices {
+				serials = append(serials, d.Serial)
+			}
+			if strings.Join(serials, ",") != strings.Join(tt.serials, ",") {
+				t.Errorf("devices = %v, want %v", serials, tt.serials)
+			}
+		})
+	}
+}
+
+func TestGetDevice(t *testing.T) {
+	ts, fake, _ := newTestServer(t)
+	fake.AddDevice("offline").SetState(adb.StateOffline)
+	fake.AddDevice("unauthorized").SetState(adb.StateUnauthorized)
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/devices/emulator-5554", http.StatusOK},
+		{"/devices/missing", http.StatusNotFound},
+		{"/devices/offline", http.StatusConflict},
+		{"/devices/unauthorized/props", http.StatusConflict},
+	}
+	for _, tt := range tests {
+		resp, body := do(t, "GET", ts.URL+tt.path, nil)
+		if resp.StatusCode != tt.status {
+			t.Errorf("GET %s status = %d, want %d: %s", tt.path, resp.StatusCode, tt.status, body)
+		}
+	}
+}
+
+func TestRouting(t *testing.T) {
+	ts, _, _ := newTestServer(t)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{"GET", "/devices/emulator-5554/nope", http.StatusNotFound, ""},
+		{"GET", "/devices/emulator-5554/props/x", http.StatusNotFound, ""},
+		{"GET", "/devices/emulator-5554/files", http.StatusNotFound, ""},
+		{"GET", "/devices/", http.StatusNotFound, ""},
+		{"DELETE", "/devices/emulator-5554/files/sdcard/a", http.StatusMethodNotAllowed, "GET, PUT"},
+		{"GET", "/devices/emulator-5554/shell", http.StatusMethodNotAllowed, "POST"},
+		{"POST", "/devices", http.StatusMethodNotAllowed, "GET"},
+	}
+	for _, tt := range tests {
+		resp, body := do(t, tt.method, ts.URL+tt.path, nil)
+		if resp.StatusCode != tt.status || resp.Header.Get("Allow") != tt.allow {
+			t.Errorf("%s %s = %d, Allow %q, want %d, %q: %s", tt.method, tt.path, resp.StatusCode, resp.Header.Get("Allow"), tt.status, tt.allow, body)
+		}
+	}
+}
+
+func TestGetProps(t *testing.T) {
+	ts, _, d := newTestServer(t)
+	d.SetProp("persist.sys.locale", "en-US")
+
+	resp, body := do(t, "GET", ts.URL+"/devices/emulator-5554/props", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	var props map[string]string
+	err := json.Unmarshal(body, &props)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if props["persist.sys.locale"] != "en-US" || props["ro.serialno"] != "emulator-5554" {
+		t.Errorf("props = %v", props)
+	}
+}
+
+func TestShell(t *testing.T) {
+	ts, _, d := newTestServer(t)
+	d.RespondShell("ls /nope", adbtest.ShellResponse{Stderr: "ls: /nope: No such file or directory\n", ExitCode: 2})
+
+	tests := []struct {
+		args string
+		out  string
+		code string
+	}{
+		{`{"args": ["echo", "hi"]}`, "hi\n", "0"},
+		{`{"args": ["ls", "/nope"]}`, "ls: /nope: No such file or directory\n", "2"},
+	}
+	for _, tt := range tests {
+		resp, body := do(t, "POST", ts.URL+"/devices/emulator-5554/shell", strings.NewReader(tt.args))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, body)
+		}
+		if string(body) != tt.out {
+			t.Errorf("%s output = %q, want %q", tt.args, body, tt.out)
+		}
+		if code := resp.Trailer.Get(exitCodeTrailer); code != tt.code {
+			t.Errorf("%s exit code = %q, want %s", tt.args, code, tt.code)
+		}
+		if msg := resp.Trailer.Get(errorTrailer); msg != "" {
+			t.Errorf("%s error = %q", tt.args, msg)
+		}
+	}
+
+	resp, _ := do(t, "POST", ts.URL+"/devices/emulator-5554/shell", strings.NewReader(`{}`))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("empty args status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	ts, _, d := newTestServer(t)
+	data := bytes.Repeat([]byte("file"), 40000)
+
+	resp, body := do(t, "PUT", ts.URL+"/devices/emulator-5554/files/data/local/tmp/tool?mode=0755", bytes.NewReader(data))
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("PUT status = %d: %s", resp.StatusCode, body)
+	}
+	if mode, _ := d.FileMode("/data/local/tmp/tool"); mode != 0755 {
+		t.Errorf("pushed mode = %#o, want 0755", mode)
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/devices/emulator-5554/files/data/local/tmp/tool", nil)
+	if resp.StatusCode != http.StatusOK || !bytes.Equal(body, data) {
+		t.Errorf("GET status = %d, %d bytes, want %d", resp.StatusCode, len(body), len(data))
+	}
+
+	resp, body = do(t, "GET", ts.URL+"/devices/emulator-5554/files/missing", nil)
+	if resp.StatusCode == http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("GET of a missing file = %d %s: %s", resp.StatusCode, resp.Header.Get("Content-Type"), body)
+	}
+
+	resp, _ = do(t, "PUT", ts.URL+"/devices/emulator-5554/files/tmp/x?mode=rwx", strings.NewReader("x"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("invalid mode status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+	}
+}
+
+func TestInstall(t *testing.T) {
+	ts, fake, d := newTestServer(t)
+
+	resp, body := do(t, "POST", ts.URL+"/devices/emulator-5554/install?replace", strings.NewReader("apk"))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, body)
+	}
+	if installs := d.Installs(); len(installs) != 1 || string(installs[0]) != "apk" {
+		t.Errorf("device received %q", installs)
+	}
+
+	broken := fake.AddDevice("emulator-5556")
+	broken.RespondShell("cmd package install*", adbtest.ShellResponse{Stdout: "Failure [INSTALL_FAILED_INSUFFICIENT_STORAGE]\n"})
+	resp, body = do(t, "POST", ts.URL+"/devices/emulator-5556/install", strings.NewReader("apk"))
+	if resp.StatusCode != http.StatusUnprocessableEntity {
+		t.Fatalf("status = %d, want %d: %s", resp.StatusCode, http.StatusUnprocessableEntity, body)
+	}
+	var result adb.InstallResult
+	err := json.Unmarshal(body, &result)
+	if err != nil || result.Code != "INSTALL_FAILED_INSUFFICIENT_STORAGE" {
+		t.Errorf("result = %+v, %v", result, err)
+	}
+}
+
+func TestScreenshot(t *testing.T) {
+	ts, _, d := newTestServer(t)
+	png := "\x89PNG\r\n\x1a\n\x00fake"
+	d.RespondShell("screencap -p", adbtest.ShellResponse{Stdout: png})
+
+	resp, body := do(t, "GET", ts.URL+"/devices/emulator-5554/screenshot", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "image/png" {
+		t.Fatalf("status = %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if string(body) != png {
+		t.Errorf("screenshot = %q, want %q", body, png)
+	}
+}
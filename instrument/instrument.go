@@ -0,0 +1,124 @@
+// Package instrument runs instrumentation tests with "am instrument" and
+// reports their progress as typed events.
+package instrument
+
+import (
+	"bytes"
+	"context"
+	"sort"
+	"strings"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/apk"
+)
+
+type Options struct {
+	// Package is the test APK's package and Runner its instrumentation
+	// class, e.g. "androidx.test.runner.AndroidJUnitRunner".
+	Package string
+	Runner  string
+
+	// Args are passed to the runner with -e, e.g. "class" or "numShards".
+	Args map[string]string
+}
+
+// FromManifest returns the options running the instrumentation declared by
+// a test APK's manifest.
+func FromManifest(m *apk.Manifest) *Options {
+	runner := m.Instrument.Name
+	if strings.HasPrefix(runner, ".") {
+		runner = m.Package + runner
+	}
+	return &Options{Package: m.Package, Runner: runner}
+}
+
+// Component is the instrumentation as named on the am command line.
+func (o *Options) Component() string {
+	return o.Package + "/" + o.Runner
+}
+
+func (o *Options) args() []string {
+	args := []string{"am", "instrument", "-r", "-w"}
+
+	keys := make([]string, 0, len(o.Args))
+	for k := range o.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		args = append(args, "-e", quote(k), quote(o.Args[k]))
+	}
+	return append(args, quote(o.Component()))
+}
+
+// Run starts the instrumentation on the device behind t and streams its
+// events. The channel is closed after the RunFinished event, which is sent
+// even when the run breaks off.
+func Run(t adb.Transporter, opts *Options) <-chan Event {
+	return RunContext(context.Background(), t, opts)
+}
+
+// RunContext is like Run but stops the instrumentation output once ctx is
+// done. The tests keep running on the device. Events still pending are then
+// dropped, but RunFinished is delivered with ctx's error, so the channel must
+// be read until it is closed.
+func RunContext(ctx context.Context, t adb.Transporter, opts *Options) <-chan Event {
+	out := make(chan Event)
+	go func() {
+		defer close(out)
+
+		p := newParser(func(e Event) {
+			if e.Type == RunFinished {
+				out <- e
+				return
+			}
+			select {
+			case out <- e:
+			case <-ctx.Done():
+			}
+		})
+		w := &lineWriter{line: p.line}
+
+		cmd := adb.Command(t, opts.args()...)
+		cmd.Stdout = w
+		cmd.Stderr = w
+		err := cmd.RunContext(ctx)
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		w.flush()
+		p.finish(err)
+	}()
+	return out
+}
+
+// lineWriter hands every complete line written to it to line.
+type lineWriter struct {
+	buf  []byte
+	line func(string)
+}
+
+func (w *lineWriter) Write(b []byte) (int, error) {
+	w.buf = append(w.buf, b...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+		w.line(strings.TrimRight(string(w.buf[:i]), "\r"))
+		w.buf = w.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+func (w *lineWriter) flush() {
+	if len(w.buf) > 0 {
+		w.line(strings.TrimRight(string(w.buf), "\r"))
+		w.buf = nil
+	}
+}
+
+// quote quotes s for the device shell.
+func quote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
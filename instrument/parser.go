@@ -0,0 +1,226 @@
+package instrument
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Status codes of INSTRUMENTATION_STATUS_CODE.
+const (
+	codeStart             = 1
+	codeOk                = 0
+	codeError             = -1
+	codeFailure           = -2
+	codeIgnored           = -3
+	codeAssumptionFailure = -4
+)
+
+const (
+	statusPrefix     = "INSTRUMENTATION_STATUS: "
+	statusCodePrefix = "INSTRUMENTATION_STATUS_CODE: "
+	resultPrefix     = "INSTRUMENTATION_RESULT: "
+	codePrefix       = "INSTRUMENTATION_CODE: "
+	failedPrefix     = "INSTRUMENTATION_FAILED: "
+	abortedPrefix    = "INSTRUMENTATION_ABORTED: "
+)
+
+var timeRegex = regexp.MustCompile(`(?m)^Time: ([\d,.]+)`)
+
+type EventType int
+
+const (
+	TestStarted EventType = iota
+	TestPassed
+	TestFailed
+	TestIgnored
+	TestAssumptionFailure
+	RunFinished
+)
+
+func (t EventType) String() string {
+	switch t {
+	case TestStarted:
+		return "started"
+	case TestPassed:
+		return "passed"
+	case TestFailed:
+		return "failed"
+	case TestIgnored:
+		return "ignored"
+	case TestAssumptionFailure:
+		return "assumption failure"
+	case RunFinished:
+		return "run finished"
+	}
+	return "unknown"
+}
+
+// Event is a test changing state or the end of the run.
+type Event struct {
+	Type  EventType
+	Class string
+	Test  string
+
+	// Current is the 1-based index of the test among NumTests.
+	Current  int
+	NumTests int
+
+	// Code is the raw status code. For RunFinished it is the
+	// INSTRUMENTATION_CODE, and a test error is a TestFailed with code -1.
+	Code int
+
+	// Stack is the stack trace of a failed test.
+	Stack string
+
+	// Elapsed is the host-measured duration of a finished test, or the
+	// run time the runner reported for RunFinished.
+	Elapsed time.Duration
+
+	// Status holds every key of the status or result block.
+	Status map[string]string
+
+	// Err is set on RunFinished when the run did not complete.
+	Err error
+}
+
+// RunError reports an instrumentation run that broke off, e.g. because the
+// app under test crashed.
+type RunError struct {
+	Message string
+}
+
+func (e *RunError) Error() string {
+	return "instrument: run did not complete: " + e.Message
+}
+
+// parser turns "am instrument -r" output into events. Values may span
+// several lines; lines without a known prefix continue the last key.
+type parser struct {
+	emit func(Event)
+
+	status  map[string]string
+	result  map[string]string
+	current map[string]string // status or result, whichever is being read
+	key     string
+
+	code     *int
+	failure  string
+	started  map[string]time.Time
+	numTests int
+}
+
+func newParser(emit func(Event)) *parser {
+	return &parser{
+		emit:    emit,
+		status:  map[string]string{},
+		result:  map[string]string{},
+		started: map[string]time.Time{},
+	}
+}
+
+func (p *parser) line(line string) {
+	switch {
+	case strings.HasPrefix(line, statusPrefix):
+		p.current = p.status
+		p.set(strings.TrimPrefix(line, statusPrefix))
+	case strings.HasPrefix(line, resultPrefix):
+		p.current = p.result
+		p.set(strings.TrimPrefix(line, resultPrefix))
+	case strings.HasPrefix(line, statusCodePrefix):
+		code, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, statusCodePrefix)))
+		if err == nil {
+			p.statusDone(code)
+		}
+		p.status = map[string]string{}
+		p.current = nil
+	case strings.HasPrefix(line, codePrefix):
+		code, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(line, codePrefix)))
+		if err == nil {
+			p.code = &code
+		}
+		p.current = nil
+	case strings.HasPrefix(line, failedPrefix):
+		p.failure = strings.TrimPrefix(line, failedPrefix)
+		p.current = nil
+	case strings.HasPrefix(line, abortedPrefix):
+		p.failure = strings.TrimPrefix(line, abortedPrefix)
+		p.current = nil
+	case p.current != nil:
+		p.current[p.key] += "\n" + line
+	}
+}
+
+func (p *parser) set(kv string) {
+	key, value, _ := strings.Cut(kv, "=")
+	p.key = key
+	p.current[key] = value
+}
+
+func (p *parser) statusDone(code int) {
+	e := Event{
+		Class:  p.status["class"],
+		Test:   p.status["test"],
+		Code:   code,
+		Stack:  p.status["stack"],
+		Status: p.status,
+	}
+	e.Current, _ = strconv.Atoi(p.status["current"])
+	e.NumTests, _ = strconv.Atoi(p.status["numtests"])
+	if e.NumTests > 0 {
+		p.numTests = e.NumTests
+	}
+
+	id := e.Class + "#" + e.Test
+	switch code {
+	case codeStart:
+		e.Type = TestStarted
+		p.started[id] = time.Now()
+		p.emit(e)
+		return
+	case codeOk:
+		e.Type = TestPassed
+	case codeError, codeFailure:
+		e.Type = TestFailed
+	case codeIgnored:
+		e.Type = TestIgnored
+	case codeAssumptionFailure:
+		e.Type = TestAssumptionFailure
+	default:
+		// Custom progress statuses carry no test state.
+		return
+	}
+
+	if start, ok := p.started[id]; ok {
+		e.Elapsed = time.Since(start)
+		delete(p.started, id)
+	}
+	p.emit(e)
+}
+
+// finish sends RunFinished. err is the error the shell command ended with.
+func (p *parser) finish(err error) {
+	e := Event{Type: RunFinished, Status: p.result, NumTests: p.numTests}
+	if match := timeRegex.FindStringSubmatch(p.result["stream"]); match != nil {
+		seconds, perr := strconv.ParseFloat(strings.Replace(match[1], ",", "", -1), 64)
+		if perr == nil {
+			e.Elapsed = time.Duration(seconds * float64(time.Second))
+		}
+	}
+	if p.code != nil {
+		e.Code = *p.code
+	}
+
+	switch {
+	case p.failure != "":
+		e.Err = &RunError{Message: p.failure}
+	case p.result["shortMsg"] != "":
+		e.Err = &RunError{Message: p.result["shortMsg"]}
+	case p.code == nil && err != nil:
+		e.Err = err
+	case p.code == nil:
+		e.Err = &RunError{Message: "output ended before INSTRUMENTATION_CODE"}
+	}
+	p.emit(e)
+}
@@ -0,0 +1,173 @@
+package instrument
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// parse feeds output to a parser line by line and returns its events.
+func parse(output string, err error) []Event {
+	var events []Event
+	p := newParser(func(e Event) {
+		events = append(events, e)
+	})
+	w := &lineWriter{line: p.line}
+	w.Write([]byte(output))
+	w.flush()
+	p.finish(err)
+	return events
+}
+
+const passingRun = `INSTRUMENTATION_STATUS: class=com.example.FooTest
+INSTRUMENTATION_STATUS: current=1
+INSTRUMENTATION_STATUS: id=AndroidJUnitRunner
+INSTRUMENTATION_STATUS: numtests=3
+INSTRUMENTATION_STATUS: stream=
+com.example.FooTest:
+INSTRUMENTATION_STATUS: test=testPasses
+INSTRUMENTATION_STATUS_CODE: 1
+INSTRUMENTATION_STATUS: class=com.example.FooTest
+INSTRUMENTATION_STATUS: current=1
+INSTRUMENTATION_STATUS: numtests=3
+INSTRUMENTATION_STATUS: stream=.
+INSTRUMENTATION_STATUS: test=testPasses
+INSTRUMENTATION_STATUS_CODE: 0
+INSTRUMENTATION_STATUS: class=com.example.FooTest
+INSTRUMENTATION_STATUS: current=2
+INSTRUMENTATION_STATUS: numtests=3
+INSTRUMENTATION_STATUS: test=testFails
+INSTRUMENTATION_STATUS_CODE: 1
+INSTRUMENTATION_STATUS: class=com.example.FooTest
+INSTRUMENTATION_STATUS: current=2
+INSTRUMENTATION_STATUS: numtests=3
+INSTRUMENTATION_STATUS: stack=java.lang.AssertionError: expected:<1> but was:<2>
+	at org.junit.Assert.fail(Assert.java:89)
+	at com.example.FooTest.testFails(FooTest.java:20)
+
+INSTRUMENTATION_STATUS: test=testFails
+INSTRUMENTATION_STATUS_CODE: -2
+INSTRUMENTATION_STATUS: class=com.example.FooTest
+INSTRUMENTATION_STATUS: current=3
+INSTRUMENTATION_STATUS: numtests=3
+INSTRUMENTATION_STATUS: test=testIgnored
+INSTRUMENTATION_STATUS_CODE: -3
+INSTRUMENTATION_RESULT: stream=
+
+Time: 1,234.5
+
+FAILURES!!!
+Tests run: 2,  Failures: 1
+
+
+INSTRUMENTATION_CODE: -1
+`
+
+func TestParser(t *testing.T) {
+	events := parse(strings.Replace(passingRun, "\n", "\r\n", -1), nil)
+
+	want := []struct {
+		typ   EventType
+		test  string
+		code  int
+		stack string
+	}{
+		{TestStarted, "testPasses", 1, ""},
+		{TestPassed, "testPasses", 0, ""},
+		{TestStarted, "testFails", 1, ""},
+		{TestFailed, "testFails", -2, "java.lang.AssertionError: expected:<1> but was:<2>\n\tat org.junit.Assert.fail(Assert.java:89)\n\tat com.example.FooTest.testFails(FooTest.java:20)\n"},
+		{TestIgnored, "testIgnored", -3, ""},
+		{RunFinished, "", -1, ""},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+	for i, w := range want {
+		e := events[i]
+		if e.Type != w.typ || e.Test != w.test || e.Code != w.code || e.Stack != w.stack {
+			t.Errorf("event %d = %v %q code %d stack %q, want %v %q code %d stack %q",
+				i, e.Type, e.Test, e.Code, e.Stack, w.typ, w.test, w.code, w.stack)
+		}
+		if w.typ != RunFinished && (e.Class != "com.example.FooTest" || e.NumTests != 3) {
+			t.Errorf("event %d class %q numtests %d", i, e.Class, e.NumTests)
+		}
+	}
+
+	finished := events[len(events)-1]
+	if finished.Err != nil {
+		t.Errorf("RunFinished error = %v", finished.Err)
+	}
+	if want := 1234500 * time.Millisecond; finished.Elapsed != want {
+		t.Errorf("RunFinished elapsed = %v, want %v", finished.Elapsed, want)
+	}
+	if finished.NumTests != 3 {
+		t.Errorf("RunFinished numtests = %d, want 3", finished.NumTests)
+	}
+}
+
+func TestParserRunErrors(t *testing.T) {
+	crash := errors.New("connection reset")
+	tests := []struct {
+		name   string
+		output string
+		err    error
+		want   string
+	}{
+		{
+			name: "process crashed",
+			output: "INSTRUMENTATION_RESULT: shortMsg=Process crashed.\n" +
+				"INSTRUMENTATION_CODE: 0\n",
+			want: "instrument: run did not complete: Process crashed.",
+		},
+		{
+			name:   "failed to start",
+			output: "INSTRUMENTATION_FAILED: com.example.test/androidx.test.runner.AndroidJUnitRunner\n",
+			want:   "instrument: run did not complete: com.example.test/androidx.test.runner.AndroidJUnitRunner",
+		},
+		{
+			name:   "output cut short",
+			output: "INSTRUMENTATION_STATUS: class=com.example.FooTest\n",
+			want:   "instrument: run did not complete: output ended before INSTRUMENTATION_CODE",
+		},
+		{
+			name:   "transport error",
+			output: "INSTRUMENTATION_STATUS: class=com.example.FooTest\n",
+			err:    crash,
+			want:   crash.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := parse(tt.output, tt.err)
+			finished := events[len(events)-1]
+			if finished.Type != RunFinished {
+				t.Fatalf("last event is %v, want RunFinished", finished.Type)
+			}
+			if finished.Err == nil || finished.Err.Error() != tt.want {
+				t.Errorf("RunFinished error = %v, want %q", finished.Err, tt.want)
+			}
+		})
+	}
+}
+
+func TestCollectUnfinishedTest(t *testing.T) {
+	output := "INSTRUMENTATION_STATUS: class=com.example.FooTest\n" +
+		"INSTRUMENTATION_STATUS: test=testHangs\n" +
+		"INSTRUMENTATION_STATUS_CODE: 1\n" +
+		"INSTRUMENTATION_RESULT: shortMsg=Process crashed.\n" +
+		"INSTRUMENTATION_CODE: 0\n"
+
+	r := &Report{}
+	for _, e := range parse(output, nil) {
+		r.Add(e)
+	}
+
+	if !r.Finished || r.Err == nil || r.Passed() {
+		t.Fatalf("report finished %v err %v passed %v", r.Finished, r.Err, r.Passed())
+	}
+	if len(r.Tests) != 1 || r.Tests[0].Status != TestFailed || r.Tests[0].Code != codeError {
+		t.Errorf("tests = %+v, want one errored test", r.Tests)
+	}
+}
@@ -0,0 +1,218 @@
+package instrument
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// TestResult is the outcome of one test. Status is TestPassed, TestFailed,
+// TestIgnored or TestAssumptionFailure.
+type TestResult struct {
+	Class    string
+	Name     string
+	Status   EventType
+	Code     int
+	Stack    string
+	Duration time.Duration
+}
+
+// Report accumulates the events of a run.
+type Report struct {
+	Tests    []*TestResult
+	NumTests int
+	Time     time.Duration
+	Code     int
+	Finished bool
+	// Err is set when the run did not complete.
+	Err error
+
+	running map[string]*TestResult
+}
+
+// Collect reads events until the channel is closed and returns their report.
+func Collect(events <-chan Event) *Report {
+	r := &Report{}
+	for e := range events {
+		r.Add(e)
+	}
+	return r
+}
+
+// Add records an event. Tests still running when the run finishes are
+// reported as errors.
+func (r *Report) Add(e Event) {
+	if r.running == nil {
+		r.running = map[string]*TestResult{}
+	}
+	if e.NumTests > r.NumTests {
+		r.NumTests = e.NumTests
+	}
+
+	id := e.Class + "#" + e.Test
+	switch e.Type {
+	case TestStarted:
+		t := &TestResult{Class: e.Class, Name: e.Test, Status: TestStarted}
+		r.Tests = append(r.Tests, t)
+		r.running[id] = t
+	case TestPassed, TestFailed, TestIgnored, TestAssumptionFailure:
+		t, ok := r.running[id]
+		if !ok {
+			// Ignored tests are reported without being started.
+			t = &TestResult{Class: e.Class, Name: e.Test}
+			r.Tests = append(r.Tests, t)
+		}
+		delete(r.running, id)
+		t.Status = e.Type
+		t.Code = e.Code
+		t.Stack = e.Stack
+		t.Duration = e.Elapsed
+	case RunFinished:
+		r.Finished = true
+		r.Time = e.Elapsed
+		r.Code = e.Code
+		r.Err = e.Err
+		for id, t := range r.running {
+			t.Status = TestFailed
+			t.Code = codeError
+			t.Stack = "test did not finish"
+			if e.Err != nil {
+				t.Stack = e.Err.Error()
+			}
+			delete(r.running, id)
+		}
+	}
+}
+
+// Passed reports whether the run completed without failing tests.
+func (r *Report) Passed() bool {
+	if !r.Finished || r.Err != nil {
+		return false
+	}
+	for _, t := range r.Tests {
+		if t.Status == TestFailed {
+			return false
+		}
+	}
+	return true
+}
+
+// Merge combines the reports of several runs, such as the shards of one
+// suite. The merged run finished only if all of them did, and its Time is
+// the longest of theirs.
+func Merge(reports ...*Report) *Report {
+	merged := &Report{Finished: true}
+	for _, r := range reports {
+		merged.Tests = append(merged.Tests, r.Tests...)
+		merged.NumTests += r.NumTests
+		if r.Time > merged.Time {
+			merged.Time = r.Time
+		}
+		if !r.Finished {
+			merged.Finished = false
+		}
+		if r.Err != nil && merged.Err == nil {
+			merged.Err = r.Err
+			merged.Code = r.Code
+		}
+	}
+	return merged
+}
+
+type junitSuites struct {
+	XMLName xml.Name     `xml:"testsuites"`
+	Name    string       `xml:"name,attr,omitempty"`
+	Suites  []junitSuite `xml:"testsuite"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Skipped  int         `xml:"skipped,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	Class   string        `xml:"classname,attr"`
+	Name    string        `xml:"name,attr"`
+	Time    string        `xml:"time,attr"`
+	Failure *junitFailure `xml:"failure,omitempty"`
+	Error   *junitFailure `xml:"error,omitempty"`
+	Skipped *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr,omitempty"`
+	Body    string `xml:",chardata"`
+}
+
+// WriteJUnit writes the report as JUnit XML with one test suite per class.
+// name labels the whole run, e.g. with the device serial.
+func (r *Report) WriteJUnit(w io.Writer, name string) error {
+	doc := junitSuites{Name: name}
+	index := map[string]int{}
+	for _, t := range r.Tests {
+		i, ok := index[t.Class]
+		if !ok {
+			i = len(doc.Suites)
+			index[t.Class] = i
+			doc.Suites = append(doc.Suites, junitSuite{Name: t.Class})
+		}
+		s := &doc.Suites[i]
+
+		c := junitCase{Class: t.Class, Name: t.Name, Time: seconds(t.Duration)}
+		switch t.Status {
+		case TestFailed:
+			f := &junitFailure{Message: firstLine(t.Stack), Body: t.Stack}
+			if t.Code == codeError {
+				c.Error = f
+				s.Errors++
+			} else {
+				c.Failure = f
+				s.Failures++
+			}
+		case TestIgnored, TestAssumptionFailure:
+			c.Skipped = &struct{}{}
+			s.Skipped++
+		}
+		s.Tests++
+		s.Cases = append(s.Cases, c)
+	}
+
+	for i := range doc.Suites {
+		var total time.Duration
+		for _, t := range r.Tests {
+			if t.Class == doc.Suites[i].Name {
+				total += t.Duration
+			}
+		}
+		doc.Suites[i].Time = seconds(total)
+	}
+
+	_, err := io.WriteString(w, xml.Header)
+	if err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	err = enc.Encode(doc)
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
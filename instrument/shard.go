@@ -0,0 +1,300 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/apk"
+)
+
+var ErrNoDevices = errors.New("instrument: no devices to run on")
+
+type ShardOptions struct {
+	// AppApk is installed before TestApk. It may be empty for tests that
+	// instrument themselves.
+	AppApk  string
+	TestApk string
+	// Install defaults to replacing existing installs of test-only APKs.
+	Install *adb.InstallOptions
+
+	// Test defaults to the instrumentation declared by TestApk. Its Args
+	// are passed to every shard.
+	Test *Options
+
+	// Shards is the number of shards, one per device when zero.
+	Shards int
+	// Classes splits the suite by test class instead of by numShards and
+	// shardIndex, giving each shard a "-e class" list.
+	Classes []string
+
+	// Retries is how many times a failed shard is run again, on another
+	// device when there is one.
+	Retries int
+}
+
+// ShardResult is the final attempt of one shard.
+type ShardResult struct {
+	Index    int
+	Args     map[string]string
+	Device   *adb.Device
+	Attempts int
+	Report   *Report
+}
+
+// ExcludedDevice is a device dropped from the run, because installing to it
+// failed or it went away while running a shard.
+type ExcludedDevice struct {
+	Device *adb.Device
+	Err    error
+}
+
+type ShardRun struct {
+	// Report merges the reports of every shard.
+	Report   *Report
+	Shards   []*ShardResult
+	Excluded []ExcludedDevice
+}
+
+// RunSharded installs the APKs on every device matching filter, splits the
+// suite into shards and runs them in parallel, one shard per device at a
+// time. Failing tests are reported, not returned as an error.
+func RunSharded(a *adb.Adb, filter *adb.DeviceFilter, opts *ShardOptions) (*ShardRun, error) {
+	return RunShardedContext(context.Background(), a, filter, opts)
+}
+
+func RunShardedContext(ctx context.Context, a *adb.Adb, filter *adb.DeviceFilter, opts *ShardOptions) (*ShardRun, error) {
+	devices, err := a.ListDevicesContext(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	return RunShardsContext(ctx, devices, opts)
+}
+
+// RunShardsContext is RunShardedContext on an explicit list of devices.
+func RunShardsContext(ctx context.Context, devices []*adb.Device, opts *ShardOptions) (*ShardRun, error) {
+	test := opts.Test
+	if test == nil {
+		m, err := apk.ReadManifest(opts.TestApk)
+		if err != nil {
+			return nil, err
+		}
+		test = FromManifest(m)
+	}
+
+	run := &ShardRun{}
+	devices = run.install(ctx, devices, opts)
+	if len(devices) == 0 {
+		return run, ErrNoDevices
+	}
+
+	start := time.Now()
+	s := &scheduler{devices: devices, retries: opts.Retries}
+	for i, args := range shardArgs(opts, len(devices)) {
+		merged := map[string]string{}
+		for k, v := range test.Args {
+			merged[k] = v
+		}
+		for k, v := range args {
+			merged[k] = v
+		}
+		s.pending = append(s.pending, &shard{
+			result: &ShardResult{Index: i, Args: merged},
+			test:   &Options{Package: test.Package, Runner: test.Runner, Args: merged},
+			tried:  map[*adb.Device]bool{},
+		})
+	}
+	s.run(ctx)
+	sort.Slice(s.done, func(i, j int) bool {
+		return s.done[i].result.Index < s.done[j].result.Index
+	})
+
+	reports := make([]*Report, 0, len(s.done))
+	for _, sh := range s.done {
+		run.Shards = append(run.Shards, sh.result)
+		reports = append(reports, sh.result.Report)
+	}
+	run.Excluded = append(run.Excluded, s.excluded...)
+	run.Report = Merge(reports...)
+	run.Report.Time = time.Since(start)
+	return run, ctx.Err()
+}
+
+// install installs the APKs and returns the devices where both succeeded.
+func (run *ShardRun) install(ctx context.Context, devices []*adb.Device, opts *ShardOptions) []*adb.Device {
+	install := opts.Install
+	if install == nil {
+		install = &adb.InstallOptions{Replace: true, TestOnly: true}
+	}
+
+	for _, path := range []string{opts.AppApk, opts.TestApk} {
+		if path == "" {
+			continue
+		}
+		ok := make([]*adb.Device, 0, len(devices))
+		for _, r := range adb.InstallToDevicesContext(ctx, devices, path, install) {
+			if r.Err != nil {
+				run.Excluded = append(run.Excluded, ExcludedDevice{Device: r.Device, Err: r.Err})
+				continue
+			}
+			ok = append(ok, r.Device)
+		}
+		devices = ok
+	}
+	return devices
+}
+
+// shardArgs returns the runner arguments selecting each shard.
+func shardArgs(opts *ShardOptions, devices int) []map[string]string {
+	n := opts.Shards
+	if n <= 0 {
+		n = devices
+	}
+
+	if len(opts.Classes) > 0 {
+		if n > len(opts.Classes) {
+			n = len(opts.Classes)
+		}
+		groups := make([][]string, n)
+		for i, class := range opts.Classes {
+			groups[i%n] = append(groups[i%n], class)
+		}
+		shards := make([]map[string]string, n)
+		for i, group := range groups {
+			shards[i] = map[string]string{"class": strings.Join(group, ",")}
+		}
+		return shards
+	}
+
+	shards := make([]map[string]string, n)
+	for i := range shards {
+		if n == 1 {
+			shards[i] = map[string]string{}
+			continue
+		}
+		shards[i] = map[string]string{
+			"numShards":  strconv.Itoa(n),
+			"shardIndex": strconv.Itoa(i),
+		}
+	}
+	return shards
+}
+
+type shard struct {
+	result *ShardResult
+	test   *Options
+	tried  map[*adb.Device]bool
+}
+
+type attempt struct {
+	shard  *shard
+	device *adb.Device
+	report *Report
+}
+
+// scheduler hands pending shards to idle devices. A failed shard goes back
+// to pending and prefers a device that has not run it yet; a device whose
+// connection broke is dropped.
+type scheduler struct {
+	devices  []*adb.Device
+	retries  int
+	pending  []*shard
+	done     []*shard
+	excluded []ExcludedDevice
+}
+
+func (s *scheduler) run(ctx context.Context) {
+	idle := append([]*adb.Device(nil), s.devices...)
+	finished := make(chan attempt)
+	running := 0
+
+	for len(s.pending) > 0 || running > 0 {
+		if ctx.Err() == nil {
+			for i := 0; i < len(s.pending); {
+				sh := s.pending[i]
+				d := s.pick(sh, idle)
+				if d == nil {
+					i++
+					continue
+				}
+				idle = remove(idle, d)
+				s.pending = append(s.pending[:i], s.pending[i+1:]...)
+				sh.tried[d] = true
+				sh.result.Attempts++
+				running++
+				go func() {
+					report := Collect(RunContext(ctx, d, sh.test))
+					finished <- attempt{shard: sh, device: d, report: report}
+				}()
+			}
+		}
+
+		if running == 0 {
+			// Nothing is left to run the pending shards on.
+			for _, sh := range s.pending {
+				if sh.result.Report == nil {
+					err := ctx.Err()
+					if err == nil {
+						err = ErrNoDevices
+					}
+					sh.result.Report = &Report{Err: err}
+				}
+				s.done = append(s.done, sh)
+			}
+			s.pending = nil
+			break
+		}
+
+		a := <-finished
+		running--
+		a.shard.result.Device = a.device
+		a.shard.result.Report = a.report
+
+		var runErr *RunError
+		if a.report.Err != nil && !errors.As(a.report.Err, &runErr) && ctx.Err() == nil {
+			s.excluded = append(s.excluded, ExcludedDevice{Device: a.device, Err: a.report.Err})
+			s.devices = remove(s.devices, a.device)
+		} else {
+			idle = append(idle, a.device)
+		}
+
+		if !a.report.Passed() && a.shard.result.Attempts <= s.retries && ctx.Err() == nil {
+			s.pending = append(s.pending, a.shard)
+		} else {
+			s.done = append(s.done, a.shard)
+		}
+	}
+}
+
+// pick returns the idle device to run sh on, or nil. Devices that already
+// ran sh are only used once every device has.
+func (s *scheduler) pick(sh *shard, idle []*adb.Device) *adb.Device {
+	for _, d := range idle {
+		if !sh.tried[d] {
+			return d
+		}
+	}
+	for _, d := range s.devices {
+		if !sh.tried[d] {
+			// An untried device is busy; wait for it.
+			return nil
+		}
+	}
+	if len(idle) > 0 {
+		return idle[0]
+	}
+	return nil
+}
+
+func remove(devices []*adb.Device, d *adb.Device) []*adb.Device {
+	for i, other := range devices {
+		if other == d {
+			return append(devices[:i:i], devices[i+1:]...)
+		}
+	}
+	return devices
+}
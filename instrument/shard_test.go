@@ -0,0 +1,137 @@
+package instrument
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/wmbest2/android/adb"
+	"github.com/wmbest2/android/adb/adbtest"
+)
+
+var shardTest = &Options{Package: "com.example.test", Runner: "androidx.test.runner.AndroidJUnitRunner"}
+
+// runOutput is the output of a run of one test, passing or failing.
+func runOutput(pass bool) string {
+	code, stack := 0, ""
+	if !pass {
+		code, stack = -2, "INSTRUMENTATION_STATUS: stack=java.lang.AssertionError\n"
+	}
+	return "INSTRUMENTATION_STATUS: class=com.example.FooTest\n" +
+		"INSTRUMENTATION_STATUS: test=testFoo\n" +
+		"INSTRUMENTATION_STATUS_CODE: 1\n" +
+		"INSTRUMENTATION_STATUS: class=com.example.FooTest\n" +
+		stack +
+		"INSTRUMENTATION_STATUS: test=testFoo\n" +
+		fmt.Sprintf("INSTRUMENTATION_STATUS_CODE: %d\n", code) +
+		"INSTRUMENTATION_RESULT: stream=\n" +
+		"INSTRUMENTATION_CODE: -1\n"
+}
+
+// shardDevices starts a fake server with one device per entry of pass,
+// whose runs pass or fail accordingly, and counts the runs on each.
+func shardDevices(t *testing.T, pass ...bool) ([]*adbtest.Device, []*adb.Device, func(i int) int) {
+	t.Helper()
+
+	s, err := adbtest.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	var mu sync.Mutex
+	runs := make([]int, len(pass))
+	fakes := make([]*adbtest.Device, len(pass))
+	for i, p := range pass {
+		fakes[i] = s.AddDevice(fmt.Sprintf("emulator-%d", 5554+2*i))
+		fakes[i].HandleShell("am instrument*", func(command string, stdin io.Reader) adbtest.ShellResponse {
+			mu.Lock()
+			runs[i]++
+			mu.Unlock()
+			return adbtest.ShellResponse{Stdout: runOutput(p)}
+		})
+	}
+
+	devices, err := s.Adb().ListDevices(nil)
+	if err != nil || len(devices) != len(pass) {
+		t.Fatalf("ListDevices() = %v, %v", devices, err)
+	}
+	count := func(i int) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs[i]
+	}
+	return fakes, devices, count
+}
+
+func TestShardRetriedOnUntriedDevice(t *testing.T) {
+	_, devices, runs := shardDevices(t, false, true)
+
+	run, err := RunShardsContext(context.Background(), devices, &ShardOptions{Test: shardTest, Shards: 1, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sh := run.Shards[0]
+	if sh.Attempts != 2 || sh.Device != devices[1] || !sh.Report.Passed() {
+		t.Errorf("shard ran %d times, last on %v, passed %v", sh.Attempts, sh.Device, sh.Report.Passed())
+	}
+	if runs(0) != 1 || runs(1) != 1 {
+		t.Errorf("devices ran the shard %d and %d times, want once each", runs(0), runs(1))
+	}
+	if len(run.Excluded) != 0 {
+		t.Errorf("excluded %v after a failing test", run.Excluded)
+	}
+}
+
+func TestShardBrokenDeviceExcluded(t *testing.T) {
+	fakes, devices, runs := shardDevices(t, true, true)
+	fakes[0].SetState(adb.StateOffline)
+
+	run, err := RunShardsContext(context.Background(), devices, &ShardOptions{Test: shardTest, Shards: 2, Retries: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Excluded) != 1 || run.Excluded[0].Device != devices[0] || !errors.Is(run.Excluded[0].Err, adb.ErrDeviceOffline) {
+		t.Fatalf("excluded %+v, want the offline device", run.Excluded)
+	}
+	for _, sh := range run.Shards {
+		if sh.Device != devices[1] || !sh.Report.Passed() {
+			t.Errorf("shard %d last ran on %v, passed %v", sh.Index, sh.Device, sh.Report.Passed())
+		}
+	}
+	if runs(1) != 2 || !run.Report.Passed() {
+		t.Errorf("online device ran %d shards, run passed %v", runs(1), run.Report.Passed())
+	}
+}
+
+func TestShardsReportedWithoutDevices(t *testing.T) {
+	fakes, devices, _ := shardDevices(t, true, true)
+	for _, f := range fakes {
+		f.SetState(adb.StateOffline)
+	}
+
+	run, err := RunShardsContext(context.Background(), devices, &ShardOptions{Test: shardTest, Shards: 3, Retries: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(run.Excluded) != 2 {
+		t.Errorf("excluded %d devices, want 2", len(run.Excluded))
+	}
+	if len(run.Shards) != 3 {
+		t.Fatalf("reported %d shards, want 3", len(run.Shards))
+	}
+	for _, sh := range run.Shards {
+		if sh.Report.Passed() || sh.Report.Err == nil {
+			t.Errorf("shard %d passed with no devices", sh.Index)
+		}
+	}
+	if unrun := run.Shards[2]; unrun.Attempts != 0 || !errors.Is(unrun.Report.Err, ErrNoDevices) {
+		t.Errorf("unrun shard: %d attempts, %v", unrun.Attempts, unrun.Report.Err)
+	}
+	if run.Report.Passed() {
+		t.Error("merged report passed")
+	}
+}
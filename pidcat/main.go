@@ -52,8 +52,9 @@ func NewPidCat(pretty bool, tw int) *PidCat {
 	return &pid
 }
 
-func Clear(t adb.Transporter) {
-	adb.ShellSync(t, "logcat", "-c")
+func Clear(t adb.Transporter) error {
+	_, err := adb.ShellSync(t, "logcat", "-c")
+	return err
 }
 
 func (p *PidCat) SetAppFilters(filters ...string) {
@@ -72,7 +73,10 @@ func (p *PidCat) UpdateAppFilters(t adb.Transporter) error {
 		return nil
 	}
 
-	ps := adb.Shell(t, "ps")
+	ps, err := adb.Shell(t, "ps")
+	if err != nil {
+		return err
+	}
 
 	for line := range ps {
 		groups := PID_PARSER.FindSubmatch(line)